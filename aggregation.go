@@ -148,6 +148,7 @@ func match(function string, args map[string]interface{}, params any) (bson.D, *c
 	if err != nil {
 		return nil, core.TechnicalErrorWithError(err)
 	}
+	filterM = excludeDeleted(p.GetFilterCollectionName(context.Background()), p, filterM)
 	return bson.D{{Key: function, Value: filterM}}, nil
 }
 
@@ -66,3 +66,75 @@ func TestAggregationFromFiles(t *testing.T) {
 		})
 	}
 }
+
+// matchStageParams sono i filtri passati agli stage $match dei file di testdata/match, per nome
+// dell'aggregation: i filtri sono struct Go e non possono essere descritti nello yaml.
+var matchStageParams = map[string]map[string]any{
+	"elem_match_lines": {
+		"match": testOrderFilter{Lines: testOrderLine{Sku: "X", Qty: 3}},
+	},
+	"elem_match_history": {
+		"match": testOrderFilter{Lines: testOrderLine{Sku: "X"}, History: &testOrderLine{Qty: 1}},
+		"limit": 10,
+	},
+}
+
+// TestMatchStageFromFiles scansiona testdata/match/*.yaml e per ognuno cerca il .json gemello.
+// Genera la pipeline con i filtri di matchStageParams e verifica che corrisponda all'atteso.
+func TestMatchStageFromFiles(t *testing.T) {
+	yamlFiles, err := filepath.Glob("testdata/match/*.yaml")
+	if err != nil {
+		t.Fatalf("glob testdata/match: %v", err)
+	}
+	if len(yamlFiles) == 0 {
+		t.Fatal("nessun file yaml trovato in testdata/match/")
+	}
+
+	for _, yamlPath := range yamlFiles {
+		name := strings.TrimSuffix(filepath.Base(yamlPath), ".yaml")
+		jsonPath := filepath.Join("testdata", "match", name+".json")
+
+		t.Run(name, func(t *testing.T) {
+			rawYAML, err := os.ReadFile(yamlPath)
+			if err != nil {
+				t.Fatalf("lettura yaml: %v", err)
+			}
+
+			rawJSON, err := os.ReadFile(jsonPath)
+			if err != nil {
+				t.Fatalf("lettura json atteso (%s): %v", jsonPath, err)
+			}
+
+			a := &Aggregation{}
+			if err := yaml.Unmarshal(rawYAML, a); err != nil {
+				t.Fatalf("unmarshal yaml: %v", err)
+			}
+			params, ok := matchStageParams[a.Name]
+			if !ok {
+				t.Fatalf("filtri assenti in matchStageParams per %s", a.Name)
+			}
+
+			pipeline, appErr := GenerateAggregation(a, params)
+			if appErr != nil {
+				t.Fatalf("generate aggregation: code=%s msg=%s", appErr.Code, appErr.Message)
+			}
+
+			got := PipelineToJson(pipeline)
+			t.Logf("pipeline generata:\n%s", got)
+
+			var gotObj, wantObj interface{}
+			if err := json.Unmarshal([]byte(got), &gotObj); err != nil {
+				t.Fatalf("unmarshal pipeline generata: %v\njson: %s", err, got)
+			}
+			if err := json.Unmarshal(rawJSON, &wantObj); err != nil {
+				t.Fatalf("unmarshal json atteso: %v", err)
+			}
+
+			if !reflect.DeepEqual(gotObj, wantObj) {
+				gotPretty, _ := json.MarshalIndent(gotObj, "", "  ")
+				wantPretty, _ := json.MarshalIndent(wantObj, "", "  ")
+				t.Errorf("pipeline non corrisponde\n--- got ---\n%s\n--- want ---\n%s", gotPretty, wantPretty)
+			}
+		})
+	}
+}
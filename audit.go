@@ -0,0 +1,258 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// CreatedAtField è il campo con la data di inserimento.
+	CreatedAtField = "createdAt"
+	// CreatedByField è il campo con l'utente che ha inserito il documento.
+	CreatedByField = "createdBy"
+	// UpdatedAtField è il campo con la data dell'ultima modifica.
+	UpdatedAtField = "updatedAt"
+	// UpdatedByField è il campo con l'utente dell'ultima modifica.
+	UpdatedByField = "updatedBy"
+)
+
+var auditFieldNames = []string{CreatedAtField, CreatedByField, UpdatedAtField, UpdatedByField}
+
+// AuditFields sono i campi di audit gestiti da coremongo, da includere inline nel documento.
+type AuditFields struct {
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	CreatedBy string    `bson:"createdBy" json:"createdBy"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	UpdatedBy string    `bson:"updatedBy" json:"updatedBy"`
+}
+
+// Audit restituisce i campi di audit: includendo AuditFields il documento implementa Auditable.
+func (a *AuditFields) Audit() *AuditFields {
+	return a
+}
+
+// Auditable è implementato dai documenti con campi di audit, valorizzati da InsertOne, InsertMany,
+// UpdateOne, UpdateMany, ReplaceOne (e dalle varianti Expect), Upsert, FindOneAndUpdate, FindOneAndReplace
+// e dalle operazioni di BulkWrite con la data corrente e l'utente del principal di go-core-app nel
+// contesto. I campi di audit impostati dal chiamante vengono ignorati e createdAt non viene mai
+// sovrascritto da update e replace, neanche in upsert.
+//
+//	type Contratto struct {
+//		ID                    string `bson:"_id"`
+//		coremongo.AuditFields `bson:",inline"`
+//		...
+//	}
+//
+// I metodi di AuditFields hanno receiver puntatore: i documenti vanno passati per puntatore
+// per ricevere i valori scritti. Gli update riconoscono il documento registrato per la collection
+// del filtro (vedi RegisterDocument), i documenti passati per valore vengono riconosciuti dal tipo.
+type Auditable interface {
+	ICollection
+	Audit() *AuditFields
+}
+
+func isNilPointer(v any) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Pointer && rv.IsNil()
+}
+
+// auditStamp sono data e utente di una scrittura.
+type auditStamp struct {
+	at time.Time
+	by string
+}
+
+// newAuditStamp restituisce data corrente (alla precisione di mongo) e utente del contesto.
+func newAuditStamp(ctx context.Context) auditStamp {
+	return auditStamp{at: time.Now().UTC().Truncate(time.Millisecond), by: principal(ctx)}
+}
+
+// auditInsert valorizza i campi di audit del documento da inserire. Un documento Auditable viene
+// aggiornato sul posto; un documento Auditable solo tramite puntatore e passato per valore viene
+// convertito in bson con i campi valorizzati.
+func auditInsert(ctx context.Context, obj ICollection) (any, error) {
+	if a, ok := obj.(Auditable); ok && !isNilPointer(obj) {
+		s := newAuditStamp(ctx)
+		f := a.Audit()
+		f.CreatedAt, f.CreatedBy, f.UpdatedAt, f.UpdatedBy = s.at, s.by, s.at, s.by
+		return obj, nil
+	}
+	if !policyOfType(reflect.TypeOf(obj)).auditable {
+		return obj, nil
+	}
+	doc, err := documentWithoutAuditFields(obj)
+	if err != nil {
+		return nil, err
+	}
+	s := newAuditStamp(ctx)
+	return append(doc,
+		bson.E{Key: CreatedAtField, Value: s.at}, bson.E{Key: CreatedByField, Value: s.by},
+		bson.E{Key: UpdatedAtField, Value: s.at}, bson.E{Key: UpdatedByField, Value: s.by}), nil
+}
+
+// auditUpdate aggiunge all'update i campi di audit: updatedAt e updatedBy in $set, createdAt e
+// createdBy in $setOnInsert, così che vengano scritti solo se l'upsert inserisce il documento.
+// I campi di audit dell'update vengono rimossi da tutti gli operatori ($set, $unset, $currentDate,
+// $rename, ...), che altrimenti andrebbero in conflitto con quelli aggiunti. A una pipeline viene
+// aggiunto uno stage $set equivalente.
+func auditUpdate(update any, s auditStamp) (any, error) {
+	if pipeline, ok := updatePipeline(update); ok {
+		return append(pipeline, bson.D{{Key: "$set", Value: bson.D{
+			{Key: UpdatedAtField, Value: s.at},
+			{Key: UpdatedByField, Value: bson.D{{Key: "$literal", Value: s.by}}},
+			{Key: CreatedAtField, Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + CreatedAtField, s.at}}}},
+			{Key: CreatedByField, Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + CreatedByField, bson.D{{Key: "$literal", Value: s.by}}}}}},
+		}}}), nil
+	}
+
+	doc, err := bsonD(update)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = withoutUpdatePaths(doc, auditFieldNames...); err != nil {
+		return nil, err
+	}
+	set := bson.D{}
+	onInsert := bson.D{}
+	out := make(bson.D, 0, len(doc)+2)
+	for _, e := range doc {
+		switch e.Key {
+		case "$set":
+			set = e.Value.(bson.D)
+		case "$setOnInsert":
+			onInsert = e.Value.(bson.D)
+		default:
+			out = append(out, e)
+		}
+	}
+	set = append(set, bson.E{Key: UpdatedAtField, Value: s.at}, bson.E{Key: UpdatedByField, Value: s.by})
+	onInsert = append(onInsert, bson.E{Key: CreatedAtField, Value: s.at}, bson.E{Key: CreatedByField, Value: s.by})
+	return append(out, bson.E{Key: "$set", Value: set}, bson.E{Key: "$setOnInsert", Value: onInsert}), nil
+}
+
+// withoutUpdatePaths rimuove da tutti gli operatori dell'update i campi indicati e i loro sottocampi,
+// anche come destinazione di $rename. Gli operatori rimasti senza campi vengono rimossi.
+func withoutUpdatePaths(doc bson.D, names ...string) (bson.D, error) {
+	out := make(bson.D, 0, len(doc))
+	for _, op := range doc {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("operatore %s non valido: %T", op.Key, op.Value)
+		}
+		fields = slices.DeleteFunc(fields, func(e bson.E) bool {
+			if isUpdatePath(e.Key, names) {
+				return true
+			}
+			to, ok := e.Value.(string)
+			return op.Key == "$rename" && ok && isUpdatePath(to, names)
+		})
+		if len(fields) > 0 {
+			out = append(out, bson.E{Key: op.Key, Value: fields})
+		}
+	}
+	return out, nil
+}
+
+// isUpdatePath indica se il percorso è uno dei campi indicati o un loro sottocampo.
+func isUpdatePath(path string, names []string) bool {
+	for _, name := range names {
+		if path == name || strings.HasPrefix(path, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// bsonD restituisce il documento come bson.D, con i documenti annidati anch'essi bson.D.
+func bsonD(obj any) (bson.D, error) {
+	raw, err := bson.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// updatePipeline restituisce l'update come pipeline, se lo è.
+func updatePipeline(update any) (bson.A, bool) {
+	switch update.(type) {
+	case bson.D, bson.Raw:
+		return nil, false
+	}
+	v := reflect.ValueOf(update)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, false
+	}
+	pipeline := make(bson.A, 0, v.Len()+1)
+	for i := 0; i < v.Len(); i++ {
+		pipeline = append(pipeline, v.Index(i).Interface())
+	}
+	return pipeline, true
+}
+
+// auditReplacement restituisce la pipeline di update che sostituisce il documento mantenendo
+// createdAt e createdBy del documento esistente (o valorizzandoli, se l'upsert lo inserisce).
+func auditReplacement(obj ICollection, s auditStamp) (mongo.Pipeline, error) {
+	if a, ok := obj.(Auditable); ok && !isNilPointer(obj) {
+		f := a.Audit()
+		f.UpdatedAt, f.UpdatedBy = s.at, s.by
+	}
+	doc, err := documentWithoutAuditFields(obj)
+	if err != nil {
+		return nil, err
+	}
+	doc = append(doc, bson.E{Key: UpdatedAtField, Value: s.at}, bson.E{Key: UpdatedByField, Value: s.by})
+	return mongo.Pipeline{{{Key: "$replaceWith", Value: bson.D{{Key: "$mergeObjects", Value: bson.A{
+		bson.D{{Key: "$literal", Value: doc}},
+		bson.D{
+			{Key: CreatedAtField, Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + CreatedAtField, s.at}}}},
+			{Key: CreatedByField, Value: bson.D{{Key: "$ifNull", Value: bson.A{"$" + CreatedByField, bson.D{{Key: "$literal", Value: s.by}}}}}},
+		},
+	}}}}}}, nil
+}
+
+func documentWithoutAuditFields(obj any) (bson.D, error) {
+	doc, err := bsonD(obj)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(doc, func(e bson.E) bool {
+		return slices.Contains(auditFieldNames, e.Key)
+	}), nil
+}
+
+// replaceUpdateOptions converte le opzioni di replace in quelle dell'update con pipeline che
+// sostituisce un documento Auditable.
+func replaceUpdateOptions(ro []options.Lister[options.ReplaceOptions]) (*options.UpdateOneOptionsBuilder, error) {
+	var r options.ReplaceOptions
+	for _, l := range ro {
+		for _, set := range l.List() {
+			if err := set(&r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	uo := options.UpdateOne()
+	uo.Opts = append(uo.Opts, func(o *options.UpdateOneOptions) error {
+		o.BypassDocumentValidation = r.BypassDocumentValidation
+		o.Collation = r.Collation
+		o.Comment = r.Comment
+		o.Hint = r.Hint
+		o.Upsert = r.Upsert
+		o.Let = r.Let
+		o.Sort = r.Sort
+		return nil
+	})
+	return uo, nil
+}
@@ -0,0 +1,201 @@
+package coremongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type testAuditDoc struct {
+	ID          string `bson:"_id"`
+	Name        string `bson:"name"`
+	AuditFields `bson:",inline"`
+}
+
+func (testAuditDoc) GetCollectionName(ctx context.Context) string { return "test_audit" }
+
+func testStamp() auditStamp {
+	return auditStamp{at: time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC), by: "mario"}
+}
+
+// withTestPrincipal imposta l'utente letto dal contesto per la durata del test.
+func withTestPrincipal(t *testing.T, user string) {
+	previous := principalOf
+	principalOf = func(ctx context.Context) string { return user }
+	t.Cleanup(func() { principalOf = previous })
+}
+
+func lookupD(d bson.D, key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+func TestAuditInsert(t *testing.T) {
+	withTestPrincipal(t, "mario")
+
+	obj := &testAuditDoc{ID: "1", AuditFields: AuditFields{CreatedBy: "altro"}}
+	doc, err := auditInsert(context.Background(), obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc != obj || obj.CreatedBy != "mario" || obj.UpdatedBy != "mario" || obj.CreatedAt.IsZero() || !obj.CreatedAt.Equal(obj.UpdatedAt) {
+		t.Errorf("campi di audit non valorizzati: %+v", obj.AuditFields)
+	}
+
+	doc, err = auditInsert(context.Background(), testAuditDoc{ID: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok := doc.(bson.D)
+	if !ok {
+		t.Fatalf("atteso bson.D per un documento passato per valore, ottenuto %T", doc)
+	}
+	if by, _ := lookupD(d, CreatedByField); by != "mario" {
+		t.Errorf("createdBy errato: %v", d)
+	}
+	if len(d) != 6 {
+		t.Errorf("campi di audit duplicati: %v", d)
+	}
+}
+
+func TestBulkAudit(t *testing.T) {
+	withTestPrincipal(t, "mario")
+	ctx := context.Background()
+	RegisterDocument[testAuditDoc](ctx)
+
+	_, model, err := BulkInsert(testAuditDoc{ID: "1"}).build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if by, _ := lookupD(model.(*mongo.InsertOneModel).Document.(bson.D), CreatedByField); by != "mario" {
+		t.Errorf("createdBy non valorizzato nella bulk insert: %v", model)
+	}
+
+	_, model, err = BulkUpdateOne(NewQuery("test_audit", Where("_id").Eq("1")), NewUpdate().Set("name", "x")).build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := lookupD(model.(*mongo.UpdateOneModel).Update.(bson.D), "$set")
+	if by, _ := lookupD(set.(bson.D), UpdatedByField); by != "mario" {
+		t.Errorf("updatedBy non valorizzato nella bulk update: %v", set)
+	}
+
+	obj := &testAuditDoc{ID: "1", Name: "x"}
+	_, model, err = BulkUpsert(NewQuery("test_audit", Where("_id").Eq("1")), obj).build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, ok := model.(*mongo.UpdateOneModel)
+	if !ok || update.Upsert == nil || !*update.Upsert {
+		t.Fatalf("atteso l'update con pipeline in upsert, ottenuto %T", model)
+	}
+	if _, ok := update.Update.(mongo.Pipeline); !ok || obj.UpdatedBy != "mario" {
+		t.Errorf("replace senza campi di audit: %v", update.Update)
+	}
+}
+
+func TestAuditUpdate(t *testing.T) {
+	s := testStamp()
+	got, err := auditUpdate(bson.M{
+		"$set": bson.M{"name": "x", CreatedAtField: time.Time{}},
+		"$inc": bson.M{"n": 1},
+	}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := got.(bson.D)
+	set, _ := lookupD(doc, "$set")
+	if _, ok := lookupD(set.(bson.D), CreatedAtField); ok {
+		t.Errorf("createdAt non deve essere in $set: %v", set)
+	}
+	if by, _ := lookupD(set.(bson.D), UpdatedByField); by != "mario" {
+		t.Errorf("updatedBy errato: %v", set)
+	}
+	onInsert, _ := lookupD(doc, "$setOnInsert")
+	if at, _ := lookupD(onInsert.(bson.D), CreatedAtField); at != s.at {
+		t.Errorf("createdAt non in $setOnInsert: %v", onInsert)
+	}
+	if _, ok := lookupD(doc, "$inc"); !ok {
+		t.Errorf("operatore $inc perso: %v", doc)
+	}
+
+	// I campi di audit vengono rimossi da tutti gli operatori, anche come sottocampi o destinazione di $rename
+	got, err = auditUpdate(bson.M{
+		"$currentDate": bson.M{UpdatedAtField: true},
+		"$unset":       bson.M{UpdatedByField: "", "note": ""},
+		"$rename":      bson.M{"old": CreatedByField},
+		"$set":         bson.M{CreatedAtField + ".x": 1},
+	}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = got.(bson.D)
+	if _, ok := lookupD(doc, "$currentDate"); ok {
+		t.Errorf("$currentDate su updatedAt non rimosso: %v", doc)
+	}
+	if _, ok := lookupD(doc, "$rename"); ok {
+		t.Errorf("$rename verso createdBy non rimosso: %v", doc)
+	}
+	unset, _ := lookupD(doc, "$unset")
+	if fields := unset.(bson.D); len(fields) != 1 || fields[0].Key != "note" {
+		t.Errorf("$unset errato: %v", unset)
+	}
+	set, _ = lookupD(doc, "$set")
+	if len(set.(bson.D)) != 2 {
+		t.Errorf("$set errato: %v", set)
+	}
+
+	pipeline, _ := PipelineUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "n", Value: 1}}}}).UpdateDocument()
+	got, err = auditUpdate(pipeline, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages := got.(bson.A); len(stages) != 2 {
+		t.Errorf("stage di audit assente: %v", stages)
+	}
+}
+
+func TestAuditReplacement(t *testing.T) {
+	obj := &testAuditDoc{ID: "1", Name: "x", AuditFields: AuditFields{CreatedBy: "altro"}}
+	pipeline, err := auditReplacement(obj, testStamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.UpdatedBy != "mario" {
+		t.Errorf("updatedBy del documento non valorizzato: %+v", obj.AuditFields)
+	}
+	merge := pipeline[0][0].Value.(bson.D)[0].Value.(bson.A)
+	doc := merge[0].(bson.D)[0].Value.(bson.D)
+	if _, ok := lookupD(doc, CreatedByField); ok {
+		t.Errorf("il replace sovrascrive createdBy: %v", doc)
+	}
+	if by, _ := lookupD(doc, UpdatedByField); by != "mario" {
+		t.Errorf("updatedBy errato: %v", doc)
+	}
+}
+
+func TestReplaceUpdateOptions(t *testing.T) {
+	uo, err := replaceUpdateOptions([]options.Lister[options.ReplaceOptions]{
+		options.Replace().SetUpsert(true).SetCollation(&options.Collation{Locale: "it"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o options.UpdateOneOptions
+	for _, set := range uo.List() {
+		if err := set(&o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.Upsert == nil || !*o.Upsert || o.Collation == nil || o.Collation.Locale != "it" {
+		t.Errorf("opzioni di replace perse: %+v", o)
+	}
+}
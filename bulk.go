@@ -0,0 +1,427 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// DefaultBulkChunkSize è il numero massimo di operazioni inviate con un solo comando bulk.
+// Il driver divide ulteriormente i comandi che superano i limiti di dimensione del server.
+const DefaultBulkChunkSize = 1000
+
+// BulkOperation è una operazione di BulkWrite, costruita con BulkInsert, BulkUpdateOne, ecc.
+type BulkOperation struct {
+	build func(ctx context.Context) (string, mongo.WriteModel, error)
+	// historyID restituisce l'_id del documento inserito dal modello, da registrare nello storico;
+	// è valorizzato solo per l'insert di un documento IHistory
+	historyID func(model mongo.WriteModel) any
+}
+
+// BulkInsert inserisce il documento nella sua collection. Gli hook e i campi di audit di un
+// documento Auditable vengono applicati come in InsertOne. Un documento IHistory senza _id lo riceve
+// prima della scrittura e, se inserito, viene registrato nello storico come create.
+func BulkInsert(obj ICollection) BulkOperation {
+	history := policyOfType(reflect.TypeOf(obj)).history
+	op := BulkOperation{build: func(ctx context.Context) (string, mongo.WriteModel, error) {
+		if errH := beforeInsert(ctx, obj); errH != nil {
+			return "", nil, errH
+		}
+		doc, err := auditInsert(ctx, obj)
+		if err != nil {
+			return "", nil, err
+		}
+		if history {
+			if doc, err = documentWithID(doc); err != nil {
+				return "", nil, err
+			}
+		}
+		return obj.GetCollectionName(ctx), mongo.NewInsertOneModel().SetDocument(doc), nil
+	}}
+	if history {
+		op.historyID = insertedID
+	}
+	return op
+}
+
+// documentWithID restituisce il documento come bson.D, con un nuovo ObjectID se non ha un _id: come
+// farebbe il driver, ma prima della scrittura, così da conoscere l'_id del documento inserito.
+func documentWithID(obj any) (bson.D, error) {
+	doc, err := bsonD(obj)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(doc, func(e bson.E) bool { return e.Key == "_id" }) {
+		doc = append(bson.D{{Key: "_id", Value: bson.NewObjectID()}}, doc...)
+	}
+	return doc, nil
+}
+
+// insertedID restituisce l'_id del documento di un insert costruito da BulkInsert con documentWithID.
+func insertedID(model mongo.WriteModel) any {
+	for _, e := range model.(*mongo.InsertOneModel).Document.(bson.D) {
+		if e.Key == "_id" {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// BulkUpdateOne aggiorna il primo documento che soddisfa il filtro. L'update è un documento
+// di update (bson.M), una pipeline (bson.A) o un IUpdate.
+func BulkUpdateOne(filter IFilter, update any) BulkOperation {
+	return bulkUpdate(filter, update, false)
+}
+
+// BulkUpdateMany aggiorna tutti i documenti che soddisfano il filtro.
+func BulkUpdateMany(filter IFilter, update any) BulkOperation {
+	return bulkUpdate(filter, update, true)
+}
+
+func bulkUpdate(filter IFilter, update any, many bool) BulkOperation {
+	return BulkOperation{build: func(ctx context.Context) (string, mongo.WriteModel, error) {
+		filterB, err := buildFilter(filter)
+		if err != nil {
+			return "", nil, err
+		}
+		collection := filter.GetFilterCollectionName(ctx)
+		doc, errU := bulkUpdateDocument(ctx, collection, policyOfCollection(collection), filter, update)
+		if errU != nil {
+			return "", nil, errU
+		}
+		if many {
+			return collection, mongo.NewUpdateManyModel().SetFilter(filterB).SetUpdate(doc).SetCollation(filterCollation(filter)), nil
+		}
+		return collection, mongo.NewUpdateOneModel().SetFilter(filterB).SetUpdate(doc).SetCollation(filterCollation(filter)), nil
+	}}
+}
+
+// bulkUpdateDocument restituisce l'update da eseguire sulla collection, controllato da IBeforeUpdate
+// e con i campi di audit e la versione del documento come in UpdateOne.
+func bulkUpdateDocument(ctx context.Context, collection string, policy *documentPolicy, filter IFilter, update any) (any, *core.ApplicationError) {
+	if errP := checkBulkPolicy(policy, collection, filter); errP != nil {
+		return nil, errP
+	}
+	return policyUpdate(ctx, policy, filter, update)
+}
+
+// checkBulkPolicy verifica che update, replace e delete possano essere eseguiti in una BulkWrite. Lo
+// storico richiede di leggere i documenti prima e dopo la scrittura e un filtro AtVersion di distinguere
+// un conflitto da un documento assente, cosa che il risultato di una BulkWrite non consente: queste
+// scritture vanno eseguite con le funzioni di collection.go, anche dentro ExecTransaction. Gli insert
+// non hanno uno stato precedente e BulkInsert registra lo storico.
+func checkBulkPolicy(policy *documentPolicy, collection string, filter IFilter) *core.ApplicationError {
+	if policy.history {
+		return core.TechnicalErrorWithCodeAndMessage("MON-HISTORY", fmt.Sprintf("i documenti di %s hanno lo storico e non possono essere scritti con una BulkWrite", collection))
+	}
+	if hasVersion(filter) {
+		return core.TechnicalErrorWithCodeAndMessage("MON-VERSION", fmt.Sprintf("un filtro AtVersion su %s non è ammesso in una BulkWrite", collection))
+	}
+	return nil
+}
+
+// BulkReplace sostituisce il documento che soddisfa il filtro.
+func BulkReplace(filter IFilter, obj ICollection) BulkOperation {
+	return bulkReplace(filter, obj, false)
+}
+
+// BulkUpsert sostituisce il documento che soddisfa il filtro o lo inserisce se non esiste.
+func BulkUpsert(filter IFilter, obj ICollection) BulkOperation {
+	return bulkReplace(filter, obj, true)
+}
+
+// bulkReplace restituisce il replace del documento, preparato da IBeforeReplace. Un documento
+// Auditable viene sostituito con l'update di auditReplacement, come in ReplaceOne; un documento
+// Versioned non è ammesso, perché un conflitto di versione non sarebbe distinguibile.
+func bulkReplace(filter IFilter, obj ICollection, upsert bool) BulkOperation {
+	return BulkOperation{build: func(ctx context.Context) (string, mongo.WriteModel, error) {
+		policy := policyOfType(reflect.TypeOf(obj))
+		if errP := checkBulkPolicy(policy, obj.GetCollectionName(ctx), filter); errP != nil {
+			return "", nil, errP
+		}
+		if policy.versioned {
+			return "", nil, core.TechnicalErrorWithCodeAndMessage("MON-VERSION", fmt.Sprintf("i documenti Versioned di %s vanno sostituiti con ReplaceOne", obj.GetCollectionName(ctx)))
+		}
+		if errH := beforeReplace(ctx, obj); errH != nil {
+			return "", nil, errH
+		}
+		filterB, err := buildFilter(filter)
+		if err != nil {
+			return "", nil, err
+		}
+		if policy.auditable {
+			pipeline, err := auditReplacement(obj, newAuditStamp(ctx))
+			if err != nil {
+				return "", nil, err
+			}
+			model := mongo.NewUpdateOneModel().SetFilter(filterB).SetUpdate(pipeline)
+			if upsert {
+				model.SetUpsert(true)
+			}
+			if c := filterCollation(filter); c != nil {
+				model.SetCollation(c)
+			}
+			return obj.GetCollectionName(ctx), model, nil
+		}
+		model := mongo.NewReplaceOneModel().SetFilter(filterB).SetReplacement(obj)
+		if upsert {
+			model.SetUpsert(true)
+		}
+		if c := filterCollation(filter); c != nil {
+			model.SetCollation(c)
+		}
+		return obj.GetCollectionName(ctx), model, nil
+	}}
+}
+
+// BulkDeleteOne rimuove il primo documento che soddisfa il filtro, controllato da IBeforeDelete. Se il
+// documento registrato per la collection implementa ISoftDelete viene marcato come cancellato e
+// conteggiato tra i modificati.
+func BulkDeleteOne(filter IFilter) BulkOperation {
+	return bulkDelete(filter, false)
+}
+
+// BulkDeleteMany rimuove tutti i documenti che soddisfano il filtro, vedi BulkDeleteOne per la
+// cancellazione logica.
+func BulkDeleteMany(filter IFilter) BulkOperation {
+	return bulkDelete(filter, true)
+}
+
+func bulkDelete(filter IFilter, many bool) BulkOperation {
+	return BulkOperation{build: func(ctx context.Context) (string, mongo.WriteModel, error) {
+		collection := filter.GetFilterCollectionName(ctx)
+		policy := policyOfCollection(collection)
+		if errP := checkBulkPolicy(policy, collection, filter); errP != nil {
+			return "", nil, errP
+		}
+		if errH := beforeDelete(ctx, policy, filter); errH != nil {
+			return "", nil, errH
+		}
+		if policy.softDelete {
+			return softDeleteModel(ctx, collection, filter, many)
+		}
+		filterB, err := buildFilter(filter)
+		if err != nil {
+			return "", nil, err
+		}
+		if many {
+			return collection, mongo.NewDeleteManyModel().SetFilter(filterB).SetCollation(filterCollation(filter)), nil
+		}
+		return collection, mongo.NewDeleteOneModel().SetFilter(filterB).SetCollation(filterCollation(filter)), nil
+	}}
+}
+
+type bulkConfig struct {
+	ordered   bool
+	chunkSize int
+}
+
+// newBulkConfig restituisce la configurazione di default modificata dalle opzioni.
+func newBulkConfig(opts []BulkOption) *bulkConfig {
+	cfg := &bulkConfig{ordered: true, chunkSize: DefaultBulkChunkSize}
+	for _, o := range opts {
+		o(cfg)
+	}
+	return cfg
+}
+
+// BulkOption configura una BulkWrite.
+type BulkOption func(*bulkConfig)
+
+// BulkOrdered imposta l'esecuzione ordinata (default): alla prima operazione fallita le successive
+// non vengono eseguite. Con false tutte le operazioni vengono tentate.
+func BulkOrdered(ordered bool) BulkOption {
+	return func(c *bulkConfig) {
+		c.ordered = ordered
+	}
+}
+
+// BulkChunkSize imposta il numero massimo di operazioni per comando (default DefaultBulkChunkSize).
+func BulkChunkSize(size int) BulkOption {
+	return func(c *bulkConfig) {
+		if size > 0 {
+			c.chunkSize = size
+		}
+	}
+}
+
+// BulkItemResult è l'esito di una operazione di BulkWrite.
+type BulkItemResult struct {
+	// Index è la posizione dell'operazione nella lista passata a BulkWrite.
+	Index int
+	// Executed indica se l'operazione è stata eseguita con successo.
+	Executed bool
+	// UpsertedID è l'_id del documento inserito da un upsert.
+	UpsertedID any
+	// Err è l'errore dell'operazione (es. mongo.WriteError con il codice del server).
+	Err error
+}
+
+// BulkResult è l'esito di una BulkWrite.
+type BulkResult struct {
+	Items         []BulkItemResult
+	InsertedCount int64
+	MatchedCount  int64
+	ModifiedCount int64
+	DeletedCount  int64
+	UpsertedCount int64
+}
+
+// Failed restituisce gli esiti delle operazioni fallite.
+func (r *BulkResult) Failed() []BulkItemResult {
+	failed := make([]BulkItemResult, 0)
+	for _, item := range r.Items {
+		if item.Err != nil {
+			failed = append(failed, item)
+		}
+	}
+	return failed
+}
+
+// errBulkNotExecuted è l'errore delle operazioni non eseguite per il fallimento di una precedente
+// in esecuzione ordinata.
+var errBulkNotExecuted = errors.New("operazione non eseguita per un errore precedente")
+
+// bulkChunk è un gruppo di operazioni consecutive sulla stessa collection.
+type bulkChunk struct {
+	collection string
+	first      int
+	models     []mongo.WriteModel
+	// history sono gli insert di documenti IHistory del blocco, da registrare nello storico
+	history []bulkHistoryInsert
+}
+
+// bulkHistoryInsert è l'insert di un documento IHistory: posizione nel blocco e _id del documento.
+type bulkHistoryInsert struct {
+	index int
+	id    any
+}
+
+// BulkWrite esegue le operazioni indicate, anche su collection diverse: le operazioni consecutive
+// sulla stessa collection vengono inviate insieme, a blocchi di BulkChunkSize. Il risultato riporta
+// l'esito di ogni operazione; se qualcuna è fallita viene restituito anche l'errore MON-BULK. Sui
+// documenti IHistory sono ammessi solo gli insert, registrati nello storico dopo ogni blocco: update,
+// replace, delete e upsert restituiscono MON-HISTORY (UpsertMany li esegue uno alla volta con Upsert).
+func BulkWrite(ctx context.Context, ms *mongolks.LinkedService, ops []BulkOperation, opts ...BulkOption) (*BulkResult, *core.ApplicationError) {
+	cfg := newBulkConfig(opts)
+	result := &BulkResult{Items: make([]BulkItemResult, len(ops))}
+	chunks, invalid := splitBulkChunks(ctx, ops, cfg.chunkSize, result.Items)
+	if invalid > 0 {
+		// Le operazioni non valide vengono segnalate prima di scrivere, così da non eseguire una lista parziale
+		return result, core.TechnicalErrorWithCodeAndMessage("MON-BULK", fmt.Sprintf("%d operazioni non valide su %d", invalid, len(ops)))
+	}
+
+	failed := 0
+	for n, chunk := range chunks {
+		coll := ms.GetCollection(chunk.collection, "")
+		res, err := coll.BulkWrite(ctx, chunk.models, options.BulkWrite().SetOrdered(cfg.ordered))
+		var bwe mongo.BulkWriteException
+		if err != nil && (!errors.As(err, &bwe) || bwe.WriteConcernError != nil) {
+			log.Error().Err(err).Msgf("Impossibile eseguire la bulk write su %s", chunk.collection)
+			return result, core.TechnicalErrorWithError(err)
+		}
+
+		chunkFailed := result.applyChunk(chunk, res, bwe.WriteErrors, cfg.ordered)
+		if errH := insertHistory(ctx, coll, chunk.insertedHistory(result.Items)); errH != nil {
+			log.Error().Err(errH).Msgf("Impossibile registrare lo storico della bulk write su %s", chunk.collection)
+			return result, core.TechnicalErrorWithError(errH)
+		}
+		failed += chunkFailed
+		if cfg.ordered && chunkFailed > 0 {
+			for _, next := range chunks[n+1:] {
+				for idx := range next.models {
+					result.Items[next.first+idx].Err = errBulkNotExecuted
+				}
+			}
+			break
+		}
+	}
+
+	if failed > 0 {
+		log.Error().Msgf("Bulk write: %d operazioni fallite su %d", failed, len(ops))
+		return result, core.TechnicalErrorWithCodeAndMessage("MON-BULK", fmt.Sprintf("%d operazioni fallite su %d", failed, len(ops)))
+	}
+	return result, nil
+}
+
+// splitBulkChunks costruisce i modelli delle operazioni e li raggruppa per collection e dimensione
+// del blocco. Restituisce anche il numero di operazioni non valide, il cui errore è riportato in items.
+func splitBulkChunks(ctx context.Context, ops []BulkOperation, chunkSize int, items []BulkItemResult) ([]*bulkChunk, int) {
+	chunks := make([]*bulkChunk, 0)
+	invalid := 0
+	for i, op := range ops {
+		items[i].Index = i
+		collection, model, err := op.build(ctx)
+		if err != nil {
+			items[i].Err = err
+			invalid++
+			continue
+		}
+		last := len(chunks) - 1
+		if last < 0 || chunks[last].collection != collection || len(chunks[last].models) == chunkSize {
+			chunks = append(chunks, &bulkChunk{collection: collection, first: i})
+			last++
+		}
+		if op.historyID != nil {
+			chunks[last].history = append(chunks[last].history, bulkHistoryInsert{index: len(chunks[last].models), id: op.historyID(model)})
+		}
+		chunks[last].models = append(chunks[last].models, model)
+	}
+	return chunks, invalid
+}
+
+// insertedHistory restituisce gli _id dei documenti IHistory inseriti con successo dal blocco.
+func (c *bulkChunk) insertedHistory(items []BulkItemResult) []any {
+	ids := make([]any, 0, len(c.history))
+	for _, h := range c.history {
+		if items[c.first+h.index].Executed {
+			ids = append(ids, h.id)
+		}
+	}
+	return ids
+}
+
+// applyChunk riporta negli esiti delle operazioni il risultato del blocco e restituisce il numero
+// di operazioni fallite. In esecuzione ordinata le operazioni dopo la prima fallita non sono eseguite.
+func (r *BulkResult) applyChunk(chunk *bulkChunk, res *mongo.BulkWriteResult, writeErrors []mongo.BulkWriteError, ordered bool) int {
+	if res != nil {
+		r.InsertedCount += res.InsertedCount
+		r.MatchedCount += res.MatchedCount
+		r.ModifiedCount += res.ModifiedCount
+		r.DeletedCount += res.DeletedCount
+		r.UpsertedCount += res.UpsertedCount
+		for idx, id := range res.UpsertedIDs {
+			r.Items[chunk.first+int(idx)].UpsertedID = id
+		}
+	}
+
+	chunkErrors := make(map[int]error, len(writeErrors))
+	stopAt := len(chunk.models)
+	for _, we := range writeErrors {
+		chunkErrors[we.Index] = we.WriteError
+		if ordered && we.Index < stopAt {
+			stopAt = we.Index
+		}
+	}
+	for idx := range chunk.models {
+		item := &r.Items[chunk.first+idx]
+		switch {
+		case chunkErrors[idx] != nil:
+			item.Err = chunkErrors[idx]
+		case idx > stopAt:
+			item.Err = errBulkNotExecuted
+		default:
+			item.Executed = true
+		}
+	}
+	return len(chunkErrors)
+}
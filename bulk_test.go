@@ -0,0 +1,158 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type testBulkDoc struct {
+	ID string `bson:"_id"`
+}
+
+func (testBulkDoc) GetCollectionName(ctx context.Context) string { return "test" }
+
+type testBadFilter struct {
+	X string `field:"x" operator:"$nope"`
+}
+
+func (testBadFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestSplitBulkChunks(t *testing.T) {
+	ctx := context.Background()
+	filter := testGroupFilter{Status: "A"}
+	ops := []BulkOperation{
+		BulkInsert(testBulkDoc{ID: "1"}),
+		BulkUpdateOne(filter, map[string]any{"$set": map[string]any{"x": 1}}),
+		BulkUpsert(filter, testBulkDoc{ID: "2"}),
+		BulkInsert(testCustomerSummary{ID: "3"}),
+		BulkDeleteOne(filter),
+	}
+	items := make([]BulkItemResult, len(ops))
+	chunks, invalid := splitBulkChunks(ctx, ops, 2, items)
+	if invalid != 0 {
+		t.Fatalf("nessuna operazione non valida attesa, ottenute %d", invalid)
+	}
+	want := []struct {
+		collection string
+		first, n   int
+	}{{"test", 0, 2}, {"test", 2, 1}, {"customers", 3, 1}, {"test", 4, 1}}
+	if len(chunks) != len(want) {
+		t.Fatalf("attesi %d blocchi, ottenuti %d", len(want), len(chunks))
+	}
+	for i, w := range want {
+		if chunks[i].collection != w.collection || chunks[i].first != w.first || len(chunks[i].models) != w.n {
+			t.Errorf("blocco %d: atteso %+v, ottenuto %s/%d/%d", i, w, chunks[i].collection, chunks[i].first, len(chunks[i].models))
+		}
+	}
+
+	items = make([]BulkItemResult, 2)
+	_, invalid = splitBulkChunks(ctx, []BulkOperation{BulkInsert(testBulkDoc{}), BulkDeleteMany(testBadFilter{X: "x"})}, 10, items)
+	if invalid != 1 || items[0].Err != nil || items[1].Err == nil || items[1].Index != 1 {
+		t.Fatalf("attesa una operazione non valida in posizione 1: %+v", items)
+	}
+}
+
+func TestBulkApplyChunk(t *testing.T) {
+	chunk := &bulkChunk{collection: "test", first: 2, models: make([]mongo.WriteModel, 4)}
+	writeErrors := []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1, Code: 11000, Message: "duplicate key"}}}
+	res := &mongo.BulkWriteResult{InsertedCount: 1, UpsertedCount: 1, UpsertedIDs: map[int64]any{0: "u"}}
+
+	ordered := &BulkResult{Items: make([]BulkItemResult, 6)}
+	if failed := ordered.applyChunk(chunk, res, writeErrors, true); failed != 1 {
+		t.Fatalf("attesa una operazione fallita, ottenute %d", failed)
+	}
+	items := ordered.Items
+	if !items[2].Executed || items[2].UpsertedID != "u" {
+		t.Errorf("operazione 2 eseguita con upsert attesa: %+v", items[2])
+	}
+	var we mongo.WriteError
+	if !errors.As(items[3].Err, &we) || we.Code != 11000 {
+		t.Errorf("operazione 3 fallita con codice 11000 attesa: %+v", items[3])
+	}
+	if items[4].Executed || !errors.Is(items[4].Err, errBulkNotExecuted) || !errors.Is(items[5].Err, errBulkNotExecuted) {
+		t.Errorf("operazioni 4 e 5 non eseguite attese: %+v %+v", items[4], items[5])
+	}
+	if len(ordered.Failed()) != 3 || ordered.InsertedCount != 1 || ordered.UpsertedCount != 1 {
+		t.Errorf("totali errati: %+v", ordered)
+	}
+
+	unordered := &BulkResult{Items: make([]BulkItemResult, 6)}
+	unordered.applyChunk(chunk, nil, writeErrors, false)
+	if !unordered.Items[4].Executed || !unordered.Items[5].Executed || unordered.Items[3].Executed {
+		t.Errorf("in esecuzione non ordinata le altre operazioni sono eseguite: %+v", unordered.Items)
+	}
+}
+
+func TestBulkPolicy(t *testing.T) {
+	ctx := context.Background()
+	RegisterDocument[testHistoryDoc](ctx)
+	RegisterDocument[testSoftDoc](ctx)
+	RegisterDocument[testVersionDoc](ctx)
+	byID := NewQuery("test_version", Raw(bson.M{"_id": "1"}))
+	historyByID := NewQuery("test_history", Raw(bson.M{"_id": "1"}))
+	tests := []struct {
+		name string
+		op   BulkOperation
+		code string
+	}{
+		{name: "update con storico", op: BulkUpdateOne(historyByID, bson.M{"$set": bson.M{"a": 1}}), code: "MON-HISTORY"},
+		{name: "delete con storico", op: BulkDeleteMany(historyByID), code: "MON-HISTORY"},
+		{name: "cancellazione logica AtVersion", op: BulkDeleteOne(AtVersion(NewQuery("test_soft", Raw(bson.M{"_id": "1"})), 3)), code: "MON-VERSION"},
+		{name: "upsert con storico", op: bulkUpsertByKey(testHistoryDoc{ID: "1"}), code: "MON-HISTORY"},
+		{name: "update AtVersion", op: BulkUpdateOne(AtVersion(byID, 3), bson.M{"$set": bson.M{"name": "x"}}), code: "MON-VERSION"},
+		{name: "replace Versioned", op: BulkReplace(byID, &testVersionDoc{ID: "1"}), code: "MON-VERSION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.op.build(ctx)
+			var appErr *core.ApplicationError
+			if !errors.As(err, &appErr) || appErr.Code != tt.code {
+				t.Errorf("atteso %s, ottenuto %v", tt.code, err)
+			}
+		})
+	}
+
+	_, model, err := BulkUpdateMany(byID, bson.M{"$set": bson.M{"name": "x"}}).build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inc, _ := lookupD(model.(*mongo.UpdateManyModel).Update.(bson.D), "$inc")
+	if v, _ := lookupD(inc.(bson.D), VersionField); v != 1 {
+		t.Errorf("versione non incrementata dalla bulk update: %v", model.(*mongo.UpdateManyModel).Update)
+	}
+}
+
+func TestBulkInsertHistory(t *testing.T) {
+	ctx := context.Background()
+	ops := []BulkOperation{BulkInsert(&testHistoryDoc{ID: "1"}), BulkInsert(testHistoryDoc{ID: "2"})}
+	items := make([]BulkItemResult, len(ops))
+	chunks, invalid := splitBulkChunks(ctx, ops, 10, items)
+	if invalid != 0 || len(chunks) != 1 {
+		t.Fatalf("insert con storico non valido: %+v", items)
+	}
+	if want := []bulkHistoryInsert{{index: 0, id: "1"}, {index: 1, id: "2"}}; !reflect.DeepEqual(chunks[0].history, want) {
+		t.Errorf("atteso %+v, ottenuto %+v", want, chunks[0].history)
+	}
+	items[1].Executed = true
+	if ids := chunks[0].insertedHistory(items); !reflect.DeepEqual(ids, []any{"2"}) {
+		t.Errorf("attesi solo gli insert eseguiti, ottenuto %v", ids)
+	}
+
+	if chunks, _ = splitBulkChunks(ctx, []BulkOperation{BulkInsert(testBulkDoc{ID: "3"})}, 10, items[:1]); chunks[0].history != nil {
+		t.Errorf("storico registrato per un documento senza IHistory: %+v", chunks[0].history)
+	}
+
+	doc, err := documentWithID(bson.M{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := lookupD(doc, "_id"); !ok || id.(bson.ObjectID).IsZero() {
+		t.Errorf("_id non generato: %v", doc)
+	}
+}
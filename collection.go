@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
 	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
@@ -20,32 +21,51 @@ type ICollection interface {
 	GetCollectionName(ctx context.Context) string
 }
 
-func GetObjectById[T ICollection](ctx context.Context, ms *mongolks.LinkedService, id string) (*T, *core.ApplicationError) {
+func GetObjectById[T ICollection](ctx context.Context, ms *mongolks.LinkedService, id string, fo ...options.Lister[options.FindOneOptions]) (*T, *core.ApplicationError) {
 	var result T
 
 	collection := result.GetCollectionName(ctx)
 	filter := bson.D{
 		bson.E{Key: "_id", Value: id},
 	}
-	err := ms.GetCollection(collection, "").FindOne(ctx, filter).Decode(&result)
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	if isSoftDelete(collection) {
+		filter = append(filter, bson.E{Key: DeletedAtField, Value: nil})
+	}
+	if projection := viewProjection[T](); projection != nil {
+		fo = append([]options.Lister[options.FindOneOptions]{projection.FindOneOptions()}, fo...)
+	}
+	err := ms.GetCollection(collection, "").FindOne(ctx, filter, fo...).Decode(&result)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, core.NotFoundError()
 		}
 		return nil, core.TechnicalErrorWithError(err)
 	}
+	if errH := afterFind(ctx, &result); errH != nil {
+		return nil, errH
+	}
 	return &result, nil
 
 }
 
 func CountDocuments(ctx context.Context, ms *mongolks.LinkedService, filter IFilter) (int64, *core.ApplicationError) {
+	return countDocuments(ctx, ms, filter.GetFilterCollectionName(ctx), filter)
+}
 
-	collection := filter.GetFilterCollectionName(ctx)
+func countDocuments(ctx context.Context, ms *mongolks.LinkedService, collection string, filter IFilter) (int64, *core.ApplicationError) {
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
 		return 0, core.TechnicalErrorWithError(errB)
 	}
-	i, err := ms.GetCollection(collection, "").CountDocuments(ctx, filterB)
+	filterB = excludeDeleted(collection, filter, filterB)
+	countB, errC := countFilter(filterB)
+	if errC != nil {
+		return 0, core.TechnicalErrorWithCodeAndMessage("MON-GEOCOUNT", errC.Error())
+	}
+	i, err := ms.GetCollection(collection, "").CountDocuments(ctx, countB, options.Count().SetCollation(filterCollation(filter)))
 	if err != nil {
 		return 0, core.TechnicalErrorWithError(err)
 	}
@@ -53,32 +73,52 @@ func CountDocuments(ctx context.Context, ms *mongolks.LinkedService, filter IFil
 
 }
 
-func GetObjectByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter) (*T, *core.ApplicationError) {
+func GetObjectByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, fo ...options.Lister[options.FindOneOptions]) (*T, *core.ApplicationError) {
 	var obj T
 	collection := obj.GetCollectionName(ctx)
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
 		return nil, core.TechnicalErrorWithError(errB)
 	}
-	err := ms.GetCollection(collection, "").FindOne(ctx, filterB).Decode(&obj)
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	projection := viewProjection[T]()
+	opts := []options.Lister[options.FindOneOptions]{options.FindOne().SetCollation(filterCollation(filter))}
+	if hasTextSearch(filterB) {
+		opts = append(opts, textSearchFindOneOptions(projection))
+	} else if projection != nil {
+		opts = append(opts, projection.FindOneOptions())
+	}
+	opts = append(opts, fo...)
+	err := ms.GetCollection(collection, "").FindOne(ctx, filterB, opts...).Decode(&obj)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return nil, core.NotFoundError()
 		}
 		return nil, core.TechnicalErrorWithError(err)
 	}
+	if errH := afterFind(ctx, &obj); errH != nil {
+		return nil, errH
+	}
 	return &obj, nil
 
 }
 
-func GetObjectsByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter) ([]*T, *core.ApplicationError) {
+func GetObjectsByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, fo ...options.Lister[options.FindOptions]) ([]*T, *core.ApplicationError) {
 	var obj T
 	collection := obj.GetCollectionName(ctx)
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
 		return nil, core.TechnicalErrorWithError(errB)
 	}
-	cur, err := ms.GetCollection(collection, "").Find(ctx, filterB)
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	opts := append(filterFindOptions(filter, filterB, viewProjection[T]()), fo...)
+	cur, err := ms.GetCollection(collection, "").Find(ctx, filterB, opts...)
 	if err != nil {
 		return nil, core.TechnicalErrorWithCodeAndMessage("MONGO-GOBF-ERRFIND", err.Error())
 	}
@@ -88,10 +128,25 @@ func GetObjectsByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedS
 	if errCur != nil {
 		return nil, core.TechnicalErrorWithCodeAndMessage("MONGO-GOBF-ERRCUR", errCur.Error())
 	}
+	if errH := afterFindAllPtr(ctx, results); errH != nil {
+		return nil, errH
+	}
 	return results, nil
 
 }
 
+// filterFindOptions restituisce le opzioni di find richieste dal filtro (collation, punteggio $text)
+// e dalla proiezione del documento vista, da anteporre a quelle del chiamante.
+func filterFindOptions(filter IFilter, filterB bson.M, projection Projection) []options.Lister[options.FindOptions] {
+	opts := []options.Lister[options.FindOptions]{options.Find().SetCollation(filterCollation(filter))}
+	if hasTextSearch(filterB) {
+		opts = append(opts, textSearchFindOptions(projection))
+	} else if projection != nil {
+		opts = append(opts, projection.FindOptions())
+	}
+	return opts
+}
+
 func GetObjectsByFilterSorted[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, sort page.SortRequest) ([]*T, *core.ApplicationError) {
 	var obj T
 	collection := obj.GetCollectionName(ctx)
@@ -99,7 +154,19 @@ func GetObjectsByFilterSorted[T ICollection](ctx context.Context, ms *mongolks.L
 	if errB != nil {
 		return nil, core.TechnicalErrorWithError(errB)
 	}
-	findOptions := options.Find().SetSort(SortToBson(sort))
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	findOptions := options.Find().SetSort(SortToBson(sort)).SetCollation(filterCollation(filter))
+	projection := viewProjection[T]()
+	if hasTextSearch(filterB) {
+		// L'ordinamento è quello richiesto: il punteggio viene solo proiettato
+		projection = projection.withTextScore()
+	}
+	if projection != nil {
+		findOptions = findOptions.SetProjection(projection.bson())
+	}
 	cur, err := ms.GetCollection(collection, "").Find(ctx, filterB, findOptions)
 	if err != nil {
 		return nil, core.TechnicalErrorWithCodeAndMessage("MONGO-GOBFS-ERRFIND", err.Error())
@@ -110,14 +177,26 @@ func GetObjectsByFilterSorted[T ICollection](ctx context.Context, ms *mongolks.L
 	if errCur != nil {
 		return nil, core.TechnicalErrorWithCodeAndMessage("MONGO-GOBFS-ERRFIND", errCur.Error())
 	}
+	if errH := afterFindAllPtr(ctx, results); errH != nil {
+		return nil, errH
+	}
 	return results, nil
 
 }
 
+// InsertOne inserisce il documento e restituisce il suo _id. I campi di audit di un documento
+// Auditable vengono valorizzati, un documento IHistory viene registrato nello storico.
 func InsertOne(ctx context.Context, ms *mongolks.LinkedService, obj ICollection, opts ...options.Lister[options.InsertOneOptions]) (any, *core.ApplicationError) {
 
+	if errH := beforeInsert(ctx, obj); errH != nil {
+		return nil, errH
+	}
+	doc, errA := auditInsert(ctx, obj)
+	if errA != nil {
+		return nil, core.TechnicalErrorWithError(errA)
+	}
 	collection := ms.GetCollection(obj.GetCollectionName(ctx), "")
-	res, errIns := collection.InsertOne(ctx, obj, opts...)
+	res, errIns := collection.InsertOne(ctx, doc, opts...)
 
 	if errIns != nil {
 		return nil, core.TechnicalErrorWithError(errIns)
@@ -125,6 +204,11 @@ func InsertOne(ctx context.Context, ms *mongolks.LinkedService, obj ICollection,
 	if res.InsertedID == nil {
 		return nil, core.NotFoundError()
 	}
+	if policyOfType(reflect.TypeOf(obj)).history {
+		if err := insertHistory(ctx, collection, []any{res.InsertedID}); err != nil {
+			return nil, core.TechnicalErrorWithError(err)
+		}
+	}
 	return res.InsertedID, nil
 }
 
@@ -138,7 +222,14 @@ func InsertMany(ctx context.Context, ms *mongolks.LinkedService, objs []ICollect
 		if collName != v.GetCollectionName(ctx) {
 			return core.TechnicalErrorWithCodeAndMessage("COLL-MIX", fmt.Sprintf("Get Collection Mix %s %s", collName, v.GetCollectionName(ctx)))
 		}
-		list = append(list, v)
+		if errH := beforeInsert(ctx, v); errH != nil {
+			return errH
+		}
+		doc, errA := auditInsert(ctx, v)
+		if errA != nil {
+			return core.TechnicalErrorWithError(errA)
+		}
+		list = append(list, doc)
 	}
 
 	collection := ms.GetCollection(collName, "")
@@ -151,103 +242,315 @@ func InsertMany(ctx context.Context, ms *mongolks.LinkedService, objs []ICollect
 		log.Error().Msg(message)
 		return core.TechnicalErrorWithCodeAndMessage("INSERT-MISMATCH", message)
 	}
+	if len(objs) > 0 && policyOfType(reflect.TypeOf(objs[0])).history {
+		if err := insertHistory(ctx, collection, res.InsertedIDs); err != nil {
+			return core.TechnicalErrorWithError(err)
+		}
+	}
 	return nil
 }
 
-func UpdateOne(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update bson.M, opts ...options.Lister[options.UpdateOneOptions]) *core.ApplicationError {
+// UpdateOne aggiorna il documento che soddisfa il filtro. L'update è un bson.M, una pipeline
+// o un IUpdate costruito con NewUpdate. Restituisce MON-AGGINC se il documento non viene
+// modificato né inserito, vedi UpdateOneExpect per gli altri controlli.
+func UpdateOne(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update any, opts ...options.Lister[options.UpdateOneOptions]) *core.ApplicationError {
+	_, err := UpdateOneExpect(ctx, ms, filter, update, ExpectModified(1), opts...)
+	return err
+}
+
+// UpdateOneExpect aggiorna il documento che soddisfa il filtro e verifica il risultato con expect.
+// Il risultato viene restituito anche quando il controllo fallisce. I campi di audit, la versione, lo
+// storico e IBeforeUpdate sono quelli del documento registrato per la collection del filtro (vedi
+// RegisterDocument). Con un filtro AtVersion un documento non trovato è un conflitto di versione
+// (MON-CONFLICT).
+func UpdateOneExpect(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateOneOptions]) (*WriteResult, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	return updateOneExpect(ctx, ms, collection, policyOfCollection(collection), filter, update, expect, opts...)
+}
 
+func updateOneExpect(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateOneOptions]) (*WriteResult, *core.ApplicationError) {
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
-		return core.TechnicalErrorWithError(errB)
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	update, errU := policyUpdate(ctx, policy, filter, update)
+	if errU != nil {
+		return nil, errU
+	}
+	if c := filterCollation(filter); c != nil {
+		opts = append(opts, options.UpdateOne().SetCollation(c))
 	}
-	collectionNotifiche := ms.GetCollection(filter.GetFilterCollectionName(ctx), "")
-	res, err := collectionNotifiche.UpdateOne(ctx, filterB, update, opts...)
+	collectionNotifiche := ms.GetCollection(collection, "")
+	var res *mongo.UpdateResult
+	err := writeWithHistory(ctx, collectionNotifiche, policy.history, HistoryUpdate, filterB, filterCollation(filter), false, func(filterB bson.M) (any, error) {
+		var errW error
+		res, errW = collectionNotifiche.UpdateOne(ctx, filterB, update, opts...)
+		if errW != nil {
+			return nil, errW
+		}
+		return res.UpsertedID, nil
+	})
 	if err != nil {
-		log.Error().Err(err).Msgf("Impossibile aggiornare %s %s", filter.GetFilterCollectionName(ctx), err.Error())
-		return core.TechnicalErrorWithError(err)
+		if hasVersion(filter) && isVersionConflictWrite(err) {
+			return nil, versionConflictError(collection)
+		}
+		log.Error().Err(err).Msgf("Impossibile aggiornare %s %s", collection, err.Error())
+		return nil, core.TechnicalErrorWithError(err)
 	}
-	if res.ModifiedCount != 1 && res.UpsertedCount != 1 {
-		log.Error().Err(err).Msg("Aggiornamento incoerente")
-		return core.TechnicalErrorWithCodeAndMessage("MON-AGGINC", "aggiornamento incoerente")
+	result := updateWriteResult(res)
+	if hasVersion(filter) && result.affected() == 0 {
+		return result, versionConflictError(collection)
 	}
-	return nil
+	return result, expect.check(*result, "aggiornamento")
 }
 
-func UpdateMany(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update bson.M, len int) *core.ApplicationError {
+// UpdateMany aggiorna i documenti che soddisfano il filtro, vedi UpdateOne per i tipi di update.
+// Restituisce MON-AGGINC se i documenti modificati non sono len, vedi UpdateManyExpect per gli altri controlli.
+func UpdateMany(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update any, len int) *core.ApplicationError {
+	_, err := UpdateManyExpect(ctx, ms, filter, update, ExpectModified(int64(len)))
+	return err
+}
 
+// UpdateManyExpect aggiorna i documenti che soddisfano il filtro e verifica il risultato con expect,
+// con i comportamenti indicati in UpdateOneExpect.
+func UpdateManyExpect(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateManyOptions]) (*WriteResult, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	return updateManyExpect(ctx, ms, collection, policyOfCollection(collection), filter, update, expect, opts...)
+}
+
+func updateManyExpect(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateManyOptions]) (*WriteResult, *core.ApplicationError) {
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
-		return core.TechnicalErrorWithError(errB)
+		return nil, core.TechnicalErrorWithError(errB)
 	}
-	collectionNotifiche := ms.GetCollection(filter.GetFilterCollectionName(ctx), "")
-	res, err := collectionNotifiche.UpdateMany(ctx, filterB, update)
+	update, errU := policyUpdate(ctx, policy, filter, update)
+	if errU != nil {
+		return nil, errU
+	}
+	if c := filterCollation(filter); c != nil {
+		opts = append(opts, options.UpdateMany().SetCollation(c))
+	}
+	collectionNotifiche := ms.GetCollection(collection, "")
+	var res *mongo.UpdateResult
+	err := writeWithHistory(ctx, collectionNotifiche, policy.history, HistoryUpdate, filterB, filterCollation(filter), true, func(filterB bson.M) (any, error) {
+		var errW error
+		res, errW = collectionNotifiche.UpdateMany(ctx, filterB, update, opts...)
+		if errW != nil {
+			return nil, errW
+		}
+		return res.UpsertedID, nil
+	})
 	if err != nil {
-		log.Error().Err(err).Msgf("Impossibile aggiornare %s %s", filter.GetFilterCollectionName(ctx), err.Error())
-		return core.TechnicalErrorWithError(err)
+		if hasVersion(filter) && isVersionConflictWrite(err) {
+			return nil, versionConflictError(collection)
+		}
+		log.Error().Err(err).Msgf("Impossibile aggiornare %s %s", collection, err.Error())
+		return nil, core.TechnicalErrorWithError(err)
 	}
-	if res.ModifiedCount != int64(len) {
-		log.Error().Err(err).Msg("Aggiornamento incoerente")
-		return core.TechnicalErrorWithCodeAndMessage("MON-AGGINC", "aggiornamento incoerente")
+	result := updateWriteResult(res)
+	if hasVersion(filter) && result.affected() == 0 {
+		return result, versionConflictError(collection)
 	}
-	return nil
+	return result, expect.check(*result, "aggiornamento")
 }
 
+// policyUpdate restituisce l'update da eseguire, controllato da IBeforeUpdate e con i campi di audit
+// e la versione del documento. Un filtro AtVersion incrementa la versione anche se il documento non
+// è Versioned.
+func policyUpdate(ctx context.Context, policy *documentPolicy, filter IFilter, update any) (any, *core.ApplicationError) {
+	update, err := updateDocument(update)
+	if err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	if errH := beforeUpdate(ctx, policy, update); errH != nil {
+		return nil, errH
+	}
+	if policy.auditable {
+		if update, err = auditUpdate(update, newAuditStamp(ctx)); err != nil {
+			return nil, core.TechnicalErrorWithError(err)
+		}
+	}
+	if policy.versioned || hasVersion(filter) {
+		if update, err = versionUpdate(update); err != nil {
+			return nil, core.TechnicalErrorWithError(err)
+		}
+	}
+	return update, nil
+}
+
+// ReplaceOne sostituisce il documento che soddisfa il filtro. Restituisce MON-AGGINC se il documento
+// non viene modificato né inserito, vedi ReplaceOneExpect per gli altri controlli.
 func ReplaceOne(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, obj ICollection, ro ...options.Lister[options.ReplaceOptions]) *core.ApplicationError {
+	_, err := ReplaceOneExpect(ctx, ms, filter, obj, ExpectModified(1), ro...)
+	return err
+}
 
+// ReplaceOneExpect sostituisce il documento che soddisfa il filtro e verifica il risultato con expect.
+// Un documento Auditable viene sostituito con un update che mantiene createdAt e createdBy; un documento
+// Versioned solo se la versione non è cambiata, altrimenti viene restituito MON-CONFLICT.
+func ReplaceOneExpect(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, obj ICollection, expect Expectation, ro ...options.Lister[options.ReplaceOptions]) (*WriteResult, *core.ApplicationError) {
+
+	if errH := beforeReplace(ctx, obj); errH != nil {
+		return nil, errH
+	}
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
-		return core.TechnicalErrorWithError(errB)
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	if c := filterCollation(filter); c != nil {
+		ro = append(ro, options.Replace().SetCollation(c))
 	}
 	collectionNotifiche := ms.GetCollection(obj.GetCollectionName(ctx), "")
-	res, err := collectionNotifiche.ReplaceOne(ctx, filterB, obj, ro...)
+	// Un documento Versioned viene scritto solo alla versione letta, con la versione successiva
+	// Un documento passato per valore viene scritto da una copia, la cui versione non torna al chiamante.
+	var version *VersionFields
+	if v, ok := versionedOf(obj); ok {
+		obj = v
+		version = v.Versioning()
+		filterB = withVersion(filterB, version.Version)
+		version.Version++
+	}
+	var res *mongo.UpdateResult
+	err := writeWithHistory(ctx, collectionNotifiche, policyOfType(reflect.TypeOf(obj)).history, HistoryReplace, filterB, filterCollation(filter), false, func(filterB bson.M) (any, error) {
+		var errW error
+		if policyOfType(reflect.TypeOf(obj)).auditable {
+			res, errW = replaceAuditable(ctx, collectionNotifiche, filterB, obj, ro)
+		} else {
+			res, errW = collectionNotifiche.ReplaceOne(ctx, filterB, obj, ro...)
+		}
+		if errW != nil {
+			return nil, errW
+		}
+		return res.UpsertedID, nil
+	})
 	if err != nil {
+		if version != nil {
+			version.Version--
+			if isVersionConflictWrite(err) {
+				return nil, versionConflictError(obj.GetCollectionName(ctx))
+			}
+		}
 		log.Error().Err(err).Msgf("Impossibile replace %s %s", obj.GetCollectionName(ctx), err.Error())
-		return core.TechnicalErrorWithError(err)
+		return nil, core.TechnicalErrorWithError(err)
 	}
-	if res.ModifiedCount != 1 && res.UpsertedCount != 1 {
-		log.Error().Err(err).Msg("Aggiornamento incoerente")
-		return core.TechnicalErrorWithCodeAndMessage("MON-AGGINC", "aggiornamento incoerente")
+	result := updateWriteResult(res)
+	if version != nil && result.affected() == 0 {
+		version.Version--
+		return result, versionConflictError(obj.GetCollectionName(ctx))
 	}
-	return nil
+	return result, expect.check(*result, "aggiornamento")
 }
 
+// DeleteOne rimuove il documento che soddisfa il filtro. Restituisce NotFoundError se non esiste,
+// vedi DeleteOneExpect per gli altri controlli.
 func DeleteOne(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, ro ...options.Lister[options.DeleteOneOptions]) *core.ApplicationError {
+	_, err := DeleteOneExpect(ctx, ms, filter, ExpectMatched(1), ro...)
+	return err
+}
+
+// DeleteOneExpect rimuove il documento che soddisfa il filtro e verifica il risultato con expect.
+// I comportamenti sono quelli del documento registrato per la collection del filtro (vedi
+// RegisterDocument): con ISoftDelete il documento viene marcato come cancellato e le opzioni di
+// delete non vengono usate.
+func DeleteOneExpect(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, expect Expectation, ro ...options.Lister[options.DeleteOneOptions]) (*WriteResult, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	return deleteOneExpect(ctx, ms, collection, policyOfCollection(collection), filter, expect, ro...)
+}
+
+func deleteOneExpect(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter, expect Expectation, ro ...options.Lister[options.DeleteOneOptions]) (*WriteResult, *core.ApplicationError) {
+	if errH := beforeDelete(ctx, policy, filter); errH != nil {
+		return nil, errH
+	}
+	if policy.softDelete {
+		return softDelete(ctx, ms, collection, policy, filter, false, expect)
+	}
 
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
-		return core.TechnicalErrorWithError(errB)
-	}
-	collectionNotifiche := ms.GetCollection(filter.GetFilterCollectionName(ctx), "")
-	res, err := collectionNotifiche.DeleteOne(ctx, filterB, ro...)
-	if err != nil {
-		log.Error().Err(err).Msgf("Impossibile rimuovere %s %s", filter.GetFilterCollectionName(ctx), err.Error())
-		return core.TechnicalErrorWithError(err)
+		return nil, core.TechnicalErrorWithError(errB)
 	}
-	if res.DeletedCount == 0 {
-		return core.NotFoundError()
+	if c := filterCollation(filter); c != nil {
+		ro = append(ro, options.DeleteOne().SetCollation(c))
 	}
-	if res.DeletedCount != 1 {
-		log.Error().Err(err).Msg("Rimozione incoerente")
-		return core.TechnicalErrorWithCodeAndMessage("MON-AGGINC", "rimozione incoerente")
+	collectionNotifiche := ms.GetCollection(collection, "")
+	var res *mongo.DeleteResult
+	err := writeWithHistory(ctx, collectionNotifiche, policy.history, HistoryDelete, filterB, filterCollation(filter), false, func(filterB bson.M) (any, error) {
+		var errW error
+		res, errW = collectionNotifiche.DeleteOne(ctx, filterB, ro...)
+		return nil, errW
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("Impossibile rimuovere %s %s", collection, err.Error())
+		return nil, core.TechnicalErrorWithError(err)
 	}
-
-	return nil
+	result := &WriteResult{Deleted: res.DeletedCount}
+	return result, expect.check(*result, "rimozione")
 }
 
+// DeleteMany rimuove i documenti che soddisfano il filtro, senza controlli sul numero di documenti
+// rimossi: vedi DeleteManyExpect.
 func DeleteMany(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, ro ...options.Lister[options.DeleteManyOptions]) *core.ApplicationError {
+	_, err := DeleteManyExpect(ctx, ms, filter, ExpectAny(), ro...)
+	return err
+}
+
+// DeleteManyExpect rimuove i documenti che soddisfano il filtro e verifica il risultato con expect.
+// Per la cancellazione logica vale quanto indicato in DeleteOneExpect.
+func DeleteManyExpect(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, expect Expectation, ro ...options.Lister[options.DeleteManyOptions]) (*WriteResult, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	return deleteManyExpect(ctx, ms, collection, policyOfCollection(collection), filter, expect, ro...)
+}
+
+func deleteManyExpect(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter, expect Expectation, ro ...options.Lister[options.DeleteManyOptions]) (*WriteResult, *core.ApplicationError) {
+	if errH := beforeDelete(ctx, policy, filter); errH != nil {
+		return nil, errH
+	}
+	if policy.softDelete {
+		return softDelete(ctx, ms, collection, policy, filter, true, expect)
+	}
 
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
-		return core.TechnicalErrorWithError(errB)
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	if c := filterCollation(filter); c != nil {
+		ro = append(ro, options.DeleteMany().SetCollation(c))
 	}
-	collectionNotifiche := ms.GetCollection(filter.GetFilterCollectionName(ctx), "")
-	_, err := collectionNotifiche.DeleteMany(ctx, filterB, ro...)
+	collectionNotifiche := ms.GetCollection(collection, "")
+	var res *mongo.DeleteResult
+	err := writeWithHistory(ctx, collectionNotifiche, policy.history, HistoryDelete, filterB, filterCollation(filter), true, func(filterB bson.M) (any, error) {
+		var errW error
+		res, errW = collectionNotifiche.DeleteMany(ctx, filterB, ro...)
+		return nil, errW
+	})
 	if err != nil {
-		log.Error().Err(err).Msgf("Impossibile rimuovere %s %s", filter.GetFilterCollectionName(ctx), err.Error())
-		return core.TechnicalErrorWithError(err)
+		log.Error().Err(err).Msgf("Impossibile rimuovere %s %s", collection, err.Error())
+		return nil, core.TechnicalErrorWithError(err)
 	}
+	result := &WriteResult{Deleted: res.DeletedCount}
+	return result, expect.check(*result, "rimozione")
+}
 
-	return nil
+// replaceAuditable sostituisce il documento Auditable con l'update di auditReplacement.
+func replaceAuditable(ctx context.Context, collection *mongo.Collection, filterB bson.M, obj ICollection, ro []options.Lister[options.ReplaceOptions]) (*mongo.UpdateResult, error) {
+	pipeline, err := auditReplacement(obj, newAuditStamp(ctx))
+	if err != nil {
+		return nil, err
+	}
+	uo, err := replaceUpdateOptions(ro)
+	if err != nil {
+		return nil, err
+	}
+	return collection.UpdateOne(ctx, filterB, pipeline, uo)
+}
+
+func updateWriteResult(res *mongo.UpdateResult) *WriteResult {
+	return &WriteResult{
+		Matched:    res.MatchedCount,
+		Modified:   res.ModifiedCount,
+		Upserted:   res.UpsertedCount,
+		UpsertedID: res.UpsertedID,
+	}
 }
 
 func ExecTransaction(ctx context.Context, ms *mongolks.LinkedService, transaction func(ctx context.Context) error) *core.ApplicationError {
@@ -332,14 +635,27 @@ func GetIds(ctx context.Context, ms *mongolks.LinkedService, filter string, coll
 }
 
 func GetPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, paging *page.Paging, opts ...options.Lister[options.FindOptions]) ([]T, *core.ApplicationError) {
-	collection := ms.GetCollection(filter.GetFilterCollectionName(ctx), "")
+	return getPageByFilter[T](ctx, ms, filter.GetFilterCollectionName(ctx), filter, paging, opts...)
+}
+
+func getPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, collectionName string, filter IFilter, paging *page.Paging, opts ...options.Lister[options.FindOptions]) ([]T, *core.ApplicationError) {
+	collection := ms.GetCollection(collectionName, "")
 
 	filterB, errB := buildFilter(filter)
 	if errB != nil {
 		return nil, core.TechnicalErrorWithError(errB)
 	}
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	filterB = excludeDeleted(collectionName, filter, filterB)
 
-	totalItems, errCount := collection.CountDocuments(ctx, filterB)
+	collation := filterCollation(filter)
+	countB, errC := countFilter(filterB)
+	if errC != nil {
+		return nil, core.TechnicalErrorWithCodeAndMessage("MON-GEOCOUNT", errC.Error())
+	}
+	totalItems, errCount := collection.CountDocuments(ctx, countB, options.Count().SetCollation(collation))
 	if errCount != nil {
 		return nil, core.TechnicalErrorWithError(errCount)
 	}
@@ -350,6 +666,15 @@ func GetPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedServ
 		return nil, errP
 	}
 
+	if collation != nil {
+		opts = append(opts, options.Find().SetCollation(collation))
+	}
+	projection := viewProjection[T]()
+	if hasTextSearch(filterB) {
+		opts = append([]options.Lister[options.FindOptions]{textSearchFindOptions(projection)}, opts...)
+	} else if projection != nil {
+		opts = append([]options.Lister[options.FindOptions]{projection.FindOptions()}, opts...)
+	}
 	if offset >= 0 {
 		opts = append(opts, options.Find().SetSkip(int64(offset)))
 		opts = append(opts, options.Find().SetLimit(int64(paging.PageSize)))
@@ -366,6 +691,9 @@ func GetPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedServ
 		return nil, core.TechnicalErrorWithError(errDecode)
 	}
 
+	if errH := afterFindAll(ctx, results); errH != nil {
+		return nil, errH
+	}
 	return results, nil
 }
 
@@ -0,0 +1,120 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	softDeleteType = reflect.TypeFor[ISoftDelete]()
+	auditableType  = reflect.TypeFor[Auditable]()
+	versionedType  = reflect.TypeFor[Versioned]()
+	historyType    = reflect.TypeFor[IHistory]()
+
+	beforeUpdateType = reflect.TypeFor[IBeforeUpdate]()
+	beforeDeleteType = reflect.TypeFor[IBeforeDelete]()
+)
+
+// documentPolicies contiene i comportamenti già calcolati per tipo di documento
+var documentPolicies sync.Map // reflect.Type -> *documentPolicy
+
+// documentCollections contiene i comportamenti dei documenti registrati con RegisterDocument
+var documentCollections sync.Map // string -> *documentPolicy
+
+// noPolicy sono i comportamenti di una collection non registrata
+var noPolicy = &documentPolicy{}
+
+// documentPolicy sono i comportamenti di scrittura di un tipo di documento, ricavati dalle interfacce
+// implementate dal tipo o dal suo puntatore: non dipendono da registrazioni o dall'ordine delle chiamate.
+type documentPolicy struct {
+	softDelete   bool
+	auditable    bool
+	versioned    bool
+	history      bool
+	beforeUpdate bool
+	beforeDelete bool
+	// hookType è il tipo su cui chiamare gli hook a livello di collection, nil se non ne implementa:
+	// ogni chiamata usa un nuovo valore zero del documento
+	hookType reflect.Type
+}
+
+// RegisterDocument registra i comportamenti del documento T (ISoftDelete, Auditable, Versioned,
+// IHistory, IBeforeUpdate, IBeforeDelete) per la sua collection. Va invocata all'avvio per ogni
+// documento con comportamenti: le funzioni che ricevono solo il filtro (UpdateOne, DeleteOne,
+// CountDocuments, Facets, $match, le bulk update e delete, ...) li ricavano dalla collection del filtro
+// e su una collection non registrata non li applicano. Le funzioni generiche su un documento T con
+// comportamenti non registrato restituiscono MON-REGISTER. NewRepository e ProvideRepository
+// registrano il documento del Repository.
+//
+//	coremongo.RegisterDocument[Cliente](ctx)
+func RegisterDocument[T ICollection](ctx context.Context) {
+	collection := collectionOf[T](ctx)
+	policy := policyOf[T]()
+	if actual, loaded := documentCollections.LoadOrStore(collection, policy); loaded && actual != policy {
+		log.Warn().Msgf("collection %s già registrata con un altro documento, %s ignorato", collection, reflect.TypeFor[T]())
+	}
+}
+
+// policyOfCollection restituisce i comportamenti del documento registrato per la collection.
+func policyOfCollection(collection string) *documentPolicy {
+	if policy, ok := documentCollections.Load(collection); ok {
+		return policy.(*documentPolicy)
+	}
+	return noPolicy
+}
+
+// checkRegistered restituisce MON-REGISTER se il documento T ha comportamenti ma la sua collection
+// non è registrata: le funzioni che ricevono solo il filtro non li applicherebbero.
+func checkRegistered[T ICollection](ctx context.Context) *core.ApplicationError {
+	if *policyOf[T]() == *noPolicy {
+		return nil
+	}
+	collection := collectionOf[T](ctx)
+	if _, ok := documentCollections.Load(collection); ok {
+		return nil
+	}
+	return core.TechnicalErrorWithCodeAndMessage("MON-REGISTER", fmt.Sprintf("documento %s della collection %s non registrato: invocare RegisterDocument all'avvio", reflect.TypeFor[T](), collection))
+}
+
+// collectionOf restituisce la collection del documento T, anche quando T è un tipo puntatore.
+func collectionOf[T ICollection](ctx context.Context) string {
+	var obj T
+	if typ := reflect.TypeFor[T](); typ.Kind() == reflect.Pointer {
+		obj = reflect.New(typ.Elem()).Interface().(T)
+	}
+	return obj.GetCollectionName(ctx)
+}
+
+// policyOf restituisce i comportamenti del documento T.
+func policyOf[T any]() *documentPolicy {
+	return policyOfType(reflect.TypeFor[T]())
+}
+
+// policyOfType restituisce i comportamenti del tipo di documento, passato per valore o per puntatore.
+func policyOfType(typ reflect.Type) *documentPolicy {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if cached, ok := documentPolicies.Load(typ); ok {
+		return cached.(*documentPolicy)
+	}
+	ptr := reflect.PointerTo(typ)
+	policy := &documentPolicy{
+		softDelete: ptr.Implements(softDeleteType),
+		auditable:  ptr.Implements(auditableType),
+		versioned:  ptr.Implements(versionedType),
+		history:    ptr.Implements(historyType),
+	}
+	policy.beforeUpdate = ptr.Implements(beforeUpdateType)
+	policy.beforeDelete = ptr.Implements(beforeDeleteType)
+	if policy.beforeUpdate || policy.beforeDelete {
+		policy.hookType = typ
+	}
+	actual, _ := documentPolicies.LoadOrStore(typ, policy)
+	return actual.(*documentPolicy)
+}
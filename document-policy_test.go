@@ -0,0 +1,36 @@
+package coremongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestPolicyOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *documentPolicy
+		want   documentPolicy
+	}{
+		{name: "senza interfacce", policy: policyOf[testBulkDoc](), want: documentPolicy{}},
+		{name: "metodo su valore", policy: policyOf[testSoftDoc](), want: documentPolicy{softDelete: true}},
+		{name: "metodo su puntatore", policy: policyOf[testSoftUnreadDoc](), want: documentPolicy{softDelete: true}},
+		{name: "campi di audit inline", policy: policyOf[testAuditDoc](), want: documentPolicy{auditable: true}},
+		{name: "versione inline", policy: policyOf[testVersionDoc](), want: documentPolicy{versioned: true}},
+		{name: "storico", policy: policyOf[testHistoryDoc](), want: documentPolicy{history: true}},
+		{name: "tipo puntatore", policy: policyOfType(reflect.TypeOf(&testSoftUnreadDoc{})), want: documentPolicy{softDelete: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if *tt.policy != tt.want {
+				t.Errorf("atteso %+v, ottenuto %+v", tt.want, *tt.policy)
+			}
+		})
+	}
+}
+
+func TestCollectionOf(t *testing.T) {
+	if got := collectionOf[*testAuditDoc](context.Background()); got != "test_audit" {
+		t.Errorf("collection errata per un tipo puntatore: %s", got)
+	}
+}
@@ -0,0 +1,110 @@
+package coremongo
+
+import (
+	"fmt"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/rs/zerolog/log"
+)
+
+// WriteResult sono i conteggi di una scrittura (update, replace o delete).
+type WriteResult struct {
+	// Matched sono i documenti che soddisfano il filtro.
+	Matched int64
+	// Modified sono i documenti effettivamente modificati: un update che non cambia nulla non li conta.
+	Modified int64
+	// Upserted sono i documenti inseriti da un upsert.
+	Upserted int64
+	// UpsertedID è l'_id del documento inserito da un upsert.
+	UpsertedID any
+	// Deleted sono i documenti rimossi.
+	Deleted int64
+}
+
+// affected sono i documenti interessati dalla scrittura: trovati o inseriti per update e replace,
+// rimossi per delete.
+func (r WriteResult) affected() int64 {
+	return r.Matched + r.Upserted + r.Deleted
+}
+
+// Expectation è il controllo dei conteggi di una scrittura. L'Expectation zero accetta qualsiasi esito.
+type Expectation struct {
+	description string
+	ok          func(r WriteResult) bool
+	// notFound indica che l'assenza di documenti interessati è un NotFoundError
+	notFound bool
+}
+
+// ExpectAny accetta qualsiasi esito.
+func ExpectAny() Expectation {
+	return Expectation{}
+}
+
+// ExpectMatched richiede esattamente n documenti interessati (trovati o inseriti, rimossi per delete).
+// Un update idempotente che non modifica il documento è valido; nessun documento è un NotFoundError.
+func ExpectMatched(n int64) Expectation {
+	return Expectation{
+		description: fmt.Sprintf("%d documenti interessati", n),
+		ok:          func(r WriteResult) bool { return r.affected() == n },
+		notFound:    n > 0,
+	}
+}
+
+// ExpectAtLeastOneMatched richiede almeno un documento interessato; nessun documento è un NotFoundError.
+func ExpectAtLeastOneMatched() Expectation {
+	return Expectation{
+		description: "almeno un documento interessato",
+		ok:          func(r WriteResult) bool { return r.affected() > 0 },
+		notFound:    true,
+	}
+}
+
+// ExpectModified richiede esattamente n documenti modificati o inseriti: è il controllo storico
+// di UpdateOne, ReplaceOne e UpdateMany.
+func ExpectModified(n int64) Expectation {
+	return Expectation{
+		description: fmt.Sprintf("%d documenti modificati", n),
+		ok:          func(r WriteResult) bool { return r.Modified+r.Upserted == n },
+	}
+}
+
+// ExpectUpserted richiede esattamente n documenti inseriti da un upsert.
+func ExpectUpserted(n int64) Expectation {
+	return Expectation{
+		description: fmt.Sprintf("%d documenti inseriti", n),
+		ok:          func(r WriteResult) bool { return r.Upserted == n },
+	}
+}
+
+// ExpectAll richiede che tutti i controlli siano soddisfatti, es. ExpectAll(ExpectMatched(1), ExpectUpserted(0)).
+func ExpectAll(expectations ...Expectation) Expectation {
+	e := Expectation{ok: func(r WriteResult) bool { return true }}
+	for _, x := range expectations {
+		if x.ok == nil {
+			continue
+		}
+		prev, next := e.ok, x.ok
+		e.ok = func(r WriteResult) bool { return prev(r) && next(r) }
+		if e.description != "" {
+			e.description += ", "
+		}
+		e.description += x.description
+		e.notFound = e.notFound || x.notFound
+	}
+	return e
+}
+
+// check verifica il risultato della scrittura; operation descrive la scrittura nel messaggio di errore
+// (es. "aggiornamento").
+func (e Expectation) check(r WriteResult, operation string) *core.ApplicationError {
+	if e.ok == nil || e.ok(r) {
+		return nil
+	}
+	if e.notFound && r.affected() == 0 {
+		return core.NotFoundError()
+	}
+	message := fmt.Sprintf("%s incoerente: attesi %s, trovati %d, modificati %d, inseriti %d, rimossi %d",
+		operation, e.description, r.Matched, r.Modified, r.Upserted, r.Deleted)
+	log.Error().Msg(message)
+	return core.TechnicalErrorWithCodeAndMessage("MON-AGGINC", message)
+}
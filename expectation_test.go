@@ -0,0 +1,39 @@
+package coremongo
+
+import (
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+)
+
+func TestExpectation(t *testing.T) {
+	cases := []struct {
+		name     string
+		expect   Expectation
+		result   WriteResult
+		wantCode string
+	}{
+		{"any", ExpectAny(), WriteResult{}, ""},
+		{"matched idempotente", ExpectMatched(1), WriteResult{Matched: 1}, ""},
+		{"matched upsert", ExpectMatched(1), WriteResult{Upserted: 1}, ""},
+		{"matched nessuno", ExpectMatched(1), WriteResult{}, "not-found"},
+		{"matched troppi", ExpectMatched(1), WriteResult{Matched: 2, Modified: 2}, "MON-AGGINC"},
+		{"almeno uno", ExpectAtLeastOneMatched(), WriteResult{Deleted: 3}, ""},
+		{"almeno uno nessuno", ExpectAtLeastOneMatched(), WriteResult{}, "not-found"},
+		{"modified", ExpectModified(1), WriteResult{Matched: 1, Modified: 1}, ""},
+		{"modified idempotente", ExpectModified(1), WriteResult{Matched: 1}, "MON-AGGINC"},
+		{"modified nessuno", ExpectModified(1), WriteResult{}, "MON-AGGINC"},
+		{"all", ExpectAll(ExpectMatched(1), ExpectUpserted(0)), WriteResult{Upserted: 1}, "MON-AGGINC"},
+	}
+	for _, c := range cases {
+		err := c.expect.check(c.result, "aggiornamento")
+		switch {
+		case c.wantCode == "" && err != nil:
+			t.Errorf("%s: errore inatteso %v", c.name, err)
+		case c.wantCode == "not-found" && (err == nil || err.Code != core.NotFoundError().Code):
+			t.Errorf("%s: atteso NotFoundError, ottenuto %v", c.name, err)
+		case c.wantCode == "MON-AGGINC" && (err == nil || err.Code != "MON-AGGINC"):
+			t.Errorf("%s: atteso MON-AGGINC, ottenuto %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Distinct restituisce i valori distinti del campo tra i documenti che soddisfano il filtro,
+// decodificati nel tipo V.
+//
+//	stati, err := coremongo.Distinct[string](ctx, ms, filtro, "stato")
+func Distinct[V any](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, field string) ([]V, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	res := ms.GetCollection(collection, "").Distinct(ctx, field, filterB, options.Distinct().SetCollation(filterCollation(filter)))
+	values := make([]V, 0)
+	if err := res.Decode(&values); err != nil {
+		log.Error().Err(err).Msgf("Impossibile leggere i valori distinti di %s.%s", collection, field)
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	return values, nil
+}
+
+// DefaultFacetBucket è il valore del bucket dei documenti fuori dagli intervalli di un BucketFacet.
+const DefaultFacetBucket = "other"
+
+// Facet è un conteggio di Facets: per valore (TermsFacet) o per intervalli (BucketFacet).
+type Facet struct {
+	// Name è il nome del facet nel risultato; se vuoto è il campo.
+	Name  string
+	Field string
+	// Limit è il numero massimo di valori restituiti da un TermsFacet (0 = tutti).
+	Limit int
+	// Unwind conta i singoli elementi di un campo array invece dell'array intero.
+	Unwind bool
+	// Boundaries sono i limiti degli intervalli di un BucketFacet, ordinati in modo crescente:
+	// ogni intervallo comprende il limite inferiore ed esclude quello superiore.
+	Boundaries []any
+}
+
+// TermsFacet conta i documenti per ogni valore del campo, dal più frequente.
+func TermsFacet(field string, limit int) Facet {
+	return Facet{Field: field, Limit: limit}
+}
+
+// BucketFacet conta i documenti per intervalli di un campo numerico o data. I documenti fuori
+// dagli intervalli sono contati nel bucket DefaultFacetBucket.
+//
+//	coremongo.BucketFacet("importo", 0, 100, 1000, 10000)
+func BucketFacet(field string, boundaries ...any) Facet {
+	return Facet{Field: field, Boundaries: boundaries}
+}
+
+func (f Facet) name() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.Field
+}
+
+// FacetBucket è il conteggio di un valore o di un intervallo. Per un intervallo Value è il limite
+// inferiore e To quello superiore; per il bucket dei valori fuori intervallo Value è DefaultFacetBucket.
+type FacetBucket struct {
+	Value any   `bson:"_id" json:"value"`
+	To    any   `bson:"-" json:"to,omitempty"`
+	Count int64 `bson:"count" json:"count"`
+}
+
+// Facets conta i documenti che soddisfano il filtro per ciascun facet, con una sola aggregazione $facet.
+// Il risultato è indicizzato per nome del facet.
+//
+//	res, err := coremongo.Facets(ctx, ms, filtro,
+//		coremongo.TermsFacet("stato", 0),
+//		coremongo.BucketFacet("createdAt", inizioAnno, inizioTrimestre, oggi))
+func Facets(ctx context.Context, ms *mongolks.LinkedService, filter IFilter, facets ...Facet) (map[string][]FacetBucket, *core.ApplicationError) {
+	return facetsOf(ctx, ms, filter.GetFilterCollectionName(ctx), filter, facets)
+}
+
+func facetsOf(ctx context.Context, ms *mongolks.LinkedService, collection string, filter IFilter, facets []Facet) (map[string][]FacetBucket, *core.ApplicationError) {
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	pipeline, errP := facetPipeline(filterB, facets)
+	if errP != nil {
+		return nil, core.TechnicalErrorWithError(errP)
+	}
+	if zerolog.GlobalLevel() < zerolog.DebugLevel {
+		log.Trace().Str("pipeline", PipelineToJson(pipeline)).Msg("facets pipeline")
+	}
+
+	cur, err := ms.GetCollection(collection, "").Aggregate(ctx, pipeline, options.Aggregate().SetCollation(filterCollation(filter)))
+	if err != nil {
+		log.Error().Err(err).Msgf("Impossibile calcolare i facet di %s", collection)
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	defer cur.Close(ctx)
+
+	result := make(map[string][]FacetBucket, len(facets))
+	if cur.Next(ctx) {
+		if err := cur.Decode(&result); err != nil {
+			return nil, core.TechnicalErrorWithError(err)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	for _, f := range facets {
+		result[f.name()] = facetBucketBounds(f, result[f.name()])
+	}
+	return result, nil
+}
+
+// facetPipeline restituisce la pipeline $match + $facet dei facet indicati.
+func facetPipeline(filterB bson.M, facets []Facet) (mongo.Pipeline, error) {
+	if len(facets) == 0 {
+		return nil, fmt.Errorf("nessun facet richiesto")
+	}
+	stages := bson.D{}
+	for _, f := range facets {
+		if f.Field == "" {
+			return nil, fmt.Errorf("facet '%s' senza campo", f.Name)
+		}
+		name := f.name()
+		for _, s := range stages {
+			if s.Key == name {
+				return nil, fmt.Errorf("facet '%s' duplicato", name)
+			}
+		}
+		facet := bson.A{}
+		if f.Unwind {
+			facet = append(facet, bson.D{{Key: "$unwind", Value: "$" + f.Field}})
+		}
+		if len(f.Boundaries) > 0 {
+			if len(f.Boundaries) < 2 {
+				return nil, fmt.Errorf("facet '%s': servono almeno due limiti", name)
+			}
+			facet = append(facet, bson.D{{Key: "$bucket", Value: bson.D{
+				{Key: "groupBy", Value: "$" + f.Field},
+				{Key: "boundaries", Value: f.Boundaries},
+				{Key: "default", Value: DefaultFacetBucket},
+				{Key: "output", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}},
+			}}})
+		} else {
+			facet = append(facet, bson.D{{Key: "$sortByCount", Value: "$" + f.Field}})
+			if f.Limit > 0 {
+				facet = append(facet, bson.D{{Key: "$limit", Value: f.Limit}})
+			}
+		}
+		stages = append(stages, bson.E{Key: name, Value: facet})
+	}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filterB}},
+		{{Key: "$facet", Value: stages}},
+	}, nil
+}
+
+// facetBucketBounds valorizza il limite superiore degli intervalli di un BucketFacet. Il bucket
+// viene riconosciuto confrontando in bson il limite inferiore, che il server restituisce nel tipo
+// con cui è stato inviato.
+func facetBucketBounds(f Facet, buckets []FacetBucket) []FacetBucket {
+	if buckets == nil {
+		buckets = []FacetBucket{}
+	}
+	for i := range buckets {
+		lower := rawValueOf(buckets[i].Value)
+		for j := 0; j < len(f.Boundaries)-1; j++ {
+			if rawValueOf(f.Boundaries[j]).Equal(lower) {
+				buckets[i].To = f.Boundaries[j+1]
+				break
+			}
+		}
+	}
+	return buckets
+}
+
+func rawValueOf(v any) bson.RawValue {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return bson.RawValue{}
+	}
+	return bson.Raw(raw).Lookup("v")
+}
@@ -0,0 +1,54 @@
+package coremongo
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestFacetPipeline(t *testing.T) {
+	pipeline, err := facetPipeline(bson.M{"status": "A"}, []Facet{
+		TermsFacet("type", 5),
+		{Name: "tags", Field: "tags", Unwind: true},
+		BucketFacet("amount", 0, 100, 1000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := PipelineToJson(pipeline)
+	want := `[{"$match":{"status":"A"}},{"$facet":{"type":[{"$sortByCount":"$type"},{"$limit":5}],"tags":[{"$unwind":"$tags"},{"$sortByCount":"$tags"}],"amount":[{"$bucket":{"groupBy":"$amount","boundaries":[0,100,1000],"default":"other","output":{"count":{"$sum":1}}}}]}}]`
+	if got != want {
+		t.Fatalf("pipeline errata\n got: %s\nwant: %s", got, want)
+	}
+
+	for name, facets := range map[string][]Facet{
+		"nessun facet": nil,
+		"senza campo":  {{Name: "x"}},
+		"duplicato":    {TermsFacet("a", 0), TermsFacet("a", 0)},
+		"un limite":    {BucketFacet("a", 1)},
+	} {
+		if _, err := facetPipeline(bson.M{}, facets); err == nil {
+			t.Errorf("%s: atteso errore", name)
+		}
+	}
+}
+
+func TestFacetBucketBounds(t *testing.T) {
+	d1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d2 := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	d3 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := BucketFacet("createdAt", d1, d2, d3)
+	buckets := facetBucketBounds(f, []FacetBucket{
+		{Value: bson.NewDateTimeFromTime(d2), Count: 3},
+		{Value: DefaultFacetBucket, Count: 1},
+	})
+	if buckets[0].To != d3 || buckets[1].To != nil {
+		t.Fatalf("limiti errati: %+v", buckets)
+	}
+
+	numbers := facetBucketBounds(BucketFacet("amount", 0, 100, 1000), []FacetBucket{{Value: int32(0), Count: 2}})
+	if numbers[0].To != 100 {
+		t.Fatalf("limite superiore errato: %+v", numbers)
+	}
+}
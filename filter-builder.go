@@ -5,110 +5,266 @@ import (
 	"fmt"
 	"maps"
 	"reflect"
+	"regexp"
+	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type IFilter interface {
 	GetFilterCollectionName(ctx context.Context) string
 }
 
-var operatorHandlers = map[string]func(string, interface{}) (bson.M, error){
-	"$eq":          handleSimpleOperator,
-	"$ne":          handleSimpleOperator,
-	"$gt":          handleSimpleOperator,
-	"$gte":         handleSimpleOperator,
-	"$lt":          handleSimpleOperator,
-	"$lte":         handleSimpleOperator,
-	"$in":          handleArrayOperator,
-	"$nin":         handleArrayOperator,
-	"$all":         handleArrayOperator,
-	"$exists":      handleBoolOperator,
-	"$startswith":  handleStartsWithOperator,
-	"$istartswith": handleIStartsWithOperator,
-	"$endswith":    handleEndsWithOperator,
-	"$iendswith":   handleIEndsWithOperator,
-	"$contains":    handleContainsOperator,
-	"$icontains":   handleIContainsOperator,
-	"$regex":       handleRegexOperator,
-	"$size":        handleSizeOperator,
+// OperatorHandler costruisce la condizione di un operatore a partire dal valore del campo.
+type OperatorHandler func(operator string, fieldValue interface{}) (bson.M, error)
+
+// operatorsMu protegge operatorHandlers e topLevelOperators dalle registrazioni concorrenti.
+var operatorsMu sync.RWMutex
+
+var operatorHandlers = map[string]OperatorHandler{
+	"$eq":            handleSimpleOperator,
+	"$ne":            handleSimpleOperator,
+	"$gt":            handleSimpleOperator,
+	"$gte":           handleSimpleOperator,
+	"$lt":            handleSimpleOperator,
+	"$lte":           handleSimpleOperator,
+	"$in":            handleArrayOperator,
+	"$nin":           handleArrayOperator,
+	"$all":           handleArrayOperator,
+	"$exists":        handleBoolOperator,
+	"$startswith":    handleStartsWithOperator,
+	"$istartswith":   handleIStartsWithOperator,
+	"$endswith":      handleEndsWithOperator,
+	"$iendswith":     handleIEndsWithOperator,
+	"$contains":      handleContainsOperator,
+	"$icontains":     handleIContainsOperator,
+	"$ieq":           handleIEqualsOperator,
+	"$regex":         handleRegexOperator,
+	"$size":          handleSizeOperator,
+	"$between":       handleBetweenOperator,
+	"$not":           handleNotOperator,
+	"$mod":           handleModOperator,
+	"$range":         handleRangeOperator,
+	"$text":          handleTextOperator,
+	"$near":          handleNearOperator,
+	"$geoWithin":     handleGeoWithinOperator,
+	"$geoIntersects": handleGeoIntersectsOperator,
+}
+
+// topLevelOperators sono gli operatori il cui risultato va aggiunto al livello del filtro
+// invece che sotto il nome del campo (es. {"$text": {...}}).
+var topLevelOperators = map[string]bool{
+	"$text": true,
+}
+
+func init() {
+	// $elemMatch costruisce ricorsivamente il filtro della struct: va registrato qui
+	// per evitare un ciclo di inizializzazione con operatorHandlers.
+	operatorHandlers["$elemMatch"] = handleElemMatchOperator
+}
+
+// RegisterOperator registra un operatore personalizzato utilizzabile nel tag `operator`.
+// La condizione restituita dall'handler viene applicata al campo indicato dal tag `field`.
+// Restituisce errore se l'operatore è già registrato.
+func RegisterOperator(operator string, handler OperatorHandler) error {
+	return registerOperator(operator, handler, false)
+}
+
+// RegisterTopLevelOperator registra un operatore personalizzato la cui condizione viene
+// aggiunta così com'è al livello del filtro, senza il nome del campo (es. $text, $expr).
+// Restituisce errore se l'operatore è già registrato.
+func RegisterTopLevelOperator(operator string, handler OperatorHandler) error {
+	return registerOperator(operator, handler, true)
+}
+
+func registerOperator(operator string, handler OperatorHandler, topLevel bool) error {
+	if operator == "" || handler == nil {
+		return fmt.Errorf("operatore e handler sono obbligatori")
+	}
+	operatorsMu.Lock()
+	defer operatorsMu.Unlock()
+	if _, ok := operatorHandlers[operator]; ok {
+		return fmt.Errorf("operatore '%s' già registrato", operator)
+	}
+	operatorHandlers[operator] = handler
+	if topLevel {
+		topLevelOperators[operator] = true
+	}
+	return nil
+}
+
+// lookupOperator restituisce l'handler dell'operatore e se la sua condizione è di primo livello.
+func lookupOperator(operator string) (OperatorHandler, bool, bool) {
+	operatorsMu.RLock()
+	defer operatorsMu.RUnlock()
+	handler, ok := operatorHandlers[operator]
+	return handler, topLevelOperators[operator], ok
+}
+
+// topLevelOperator indica se l'operatore restituisce una clausola di primo livello.
+func topLevelOperator(operator string) bool {
+	_, topLevel, _ := lookupOperator(operator)
+	return topLevel
+}
+
+// logicalOperators sono gli operatori ammessi nel tag `group`.
+var logicalOperators = map[string]bool{
+	"$or":  true,
+	"$and": true,
+	"$nor": true,
+}
+
+// logicalGroup raccoglie le clausole dei campi che appartengono allo stesso gruppo logico.
+type logicalGroup struct {
+	operator string
+	members  bson.A
 }
 
 // buildFilter converte una struct con tag specifici in un bson.M per query MongoDB.
 // La struct deve avere i campi taggati con:
 // - `field:"nome_campo_mongodb"`:  Il nome del campo in MongoDB.
 // - `operator:"$operatore"`: L'operatore MongoDB da usare (es. $eq, $in, $gt, $lt).
+// - `group:"$or:nome"` (opzionale): inserisce il campo nel gruppo logico indicato ($or, $and, $nor).
+// - `collation:"locale"` (opzionale): confronto case-insensitive tramite collation invece del flag `i`.
+// Una struct annidata con il solo tag `group` diventa un unico membro del gruppo, con i suoi campi in AND.
+// Le struct embedded vengono appiattite, mentre una struct annidata con il solo tag `field`
+// usa il tag come prefisso per i suoi campi (es. `address` + `city` diventa `address.city`).
+// I puntatori nil sono considerati non valorizzati e i campi non esportati vengono ignorati.
 func buildFilter(inputStruct IFilter) (bson.M, error) {
+	filter, err := buildFilterBson(inputStruct)
+	if err != nil {
+		return nil, err
+	}
+	if zerolog.GlobalLevel() < zerolog.DebugLevel {
+
+		log.Trace().Msgf("mongo filter: %v", FilterToJson(filter))
+	}
+
+	return filter, nil
+}
+
+// buildFilterBson costruisce il filtro: i filtri IBsonFilter producono direttamente il proprio bson,
+// le altre struct vengono lette tramite il piano compilato dei tag.
+func buildFilterBson(inputStruct IFilter) (bson.M, error) {
+	if bf, ok := inputStruct.(IBsonFilter); ok {
+		return bf.Bson()
+	}
+	val, err := filterStructValue(inputStruct)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := getFilterPlan(val.Type())
+	if err != nil {
+		return nil, err
+	}
+	return plan.build(val)
+}
+
+// filterStructValue restituisce il valore della struct filtro, dereferenziando il puntatore.
+func filterStructValue(inputStruct IFilter) (reflect.Value, error) {
 	if inputStruct == nil {
-		return nil, fmt.Errorf("input non puo essere nil")
+		return reflect.Value{}, fmt.Errorf("input non puo essere nil")
 	}
 	val := reflect.ValueOf(inputStruct)
-	typ := reflect.TypeOf(inputStruct)
 	// Se è un puntatore, dereferenzialo
-	if typ.Kind() == reflect.Ptr {
+	if val.Kind() == reflect.Ptr {
 		if val.IsNil() {
-			return nil, fmt.Errorf("input non può essere un puntatore nil")
+			return reflect.Value{}, fmt.Errorf("input non può essere un puntatore nil")
 		}
 		val = val.Elem()
-		typ = val.Type()
 	}
 	// Verifica che l'input sia una struct
-	if typ.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("input non è una struct")
+	if val.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("input non è una struct")
 	}
+	return val, nil
+}
 
-	filter := bson.M{}
-
-	// Itera attraverso i campi della struct
-	for i := 0; i < typ.NumField(); i++ {
-		field := typ.Field(i)
-		fieldValue := val.Field(i).Interface()
-		valField := val.Field(i) // Get reflect.Value for IsZero() check
-
-		// Ottieni i tag 'field' e 'operator'
-		fieldNameTag := field.Tag.Get("field")
-		operatorTag := field.Tag.Get("operator")
+// wrappedFilter è un filtro che estende un altro filtro (Query, WithDeleted, AtVersion).
+type wrappedFilter interface {
+	unwrap() IFilter
+}
 
-		// Se mancano i tag 'field' o 'operator', salta il campo
-		if fieldNameTag == "" || operatorTag == "" {
-			continue
+// filterCollation restituisce la collation case-insensitive richiesta dal tag `collation`
+// dei campi del filtro, nil se nessun campo valorizzato la richiede.
+func filterCollation(inputStruct IFilter) *options.Collation {
+	// Una Query eredita la collation della struct taggata che estende
+	// (anche attraverso WithDeleted e AtVersion)
+	for {
+		w, ok := inputStruct.(wrappedFilter)
+		if !ok {
+			break
 		}
-
-		_, ok := field.Tag.Lookup("omitempty")
-		if ok && valField.IsZero() {
-			continue
+		if inputStruct = w.unwrap(); inputStruct == nil {
+			return nil
 		}
+	}
+	val, err := filterStructValue(inputStruct)
+	if err != nil {
+		return nil
+	}
+	plan, err := getFilterPlan(val.Type())
+	if err != nil || plan.collation == "" {
+		return nil
+	}
+	// La collation vale per l'intera query: si applica solo se un campo che la richiede produce una condizione
+	if _, used, err := plan.buildWithCollation(val); err != nil || !used {
+		return nil
+	}
+	return &options.Collation{Locale: plan.collation, Strength: 2}
+}
 
-		// Usa il nome del campo dal tag 'field' per il bson.M
-		bsonFieldName := fieldNameTag
-
-		handler, ok := operatorHandlers[operatorTag]
+// mergeClause aggiunge una clausola al filtro, unendo gli operatori se il campo è già presente.
+// Un operatore logico già presente deve avere come valore un bson.A, altrimenti restituisce errore.
+func mergeClause(filter bson.M, clause bson.M) error {
+	for key, value := range clause {
+		previousFilter, ok := filter[key]
 		if !ok {
-			return nil, fmt.Errorf("operatore '%s' non supportato per il campo '%s'", operatorTag, fieldNameTag)
+			filter[key] = value
+			continue
 		}
-
-		opFilter, err := handler(operatorTag, fieldValue)
-		if err != nil {
-			return nil, fmt.Errorf("errore per campo '%s' operatore '%s': %w", fieldNameTag, operatorTag, err)
+		if logicalOperators[key] {
+			members, okMembers := value.(bson.A)
+			if !okMembers {
+				return fmt.Errorf("operatore '%s' richiede un valore di tipo bson.A, ricevuto %T", key, value)
+			}
+			appendLogicalGroup(filter, &logicalGroup{operator: key, members: members})
+			continue
 		}
-		previousFilter, ok := filter[bsonFieldName]
-
-		if !ok {
-			filter[bsonFieldName] = opFilter
-		} else {
-			maps.Copy(previousFilter.(bson.M), opFilter)
+		previousM, okPrevious := previousFilter.(bson.M)
+		valueM, okValue := value.(bson.M)
+		if okPrevious && okValue {
+			maps.Copy(previousM, valueM)
+			continue
 		}
-
+		// Condizioni non unibili sullo stesso campo: la nuova viene messa in AND
+		previous, _ := filter["$and"].(bson.A)
+		filter["$and"] = append(previous, bson.M{key: value})
 	}
-	if zerolog.GlobalLevel() < zerolog.DebugLevel {
+	return nil
+}
 
-		log.Trace().Msgf("mongo filter: %v", FilterToJson(filter))
+// appendLogicalGroup aggiunge il gruppo al filtro. Se l'operatore è già presente
+// (es. due gruppi $or distinti) il nuovo gruppo viene messo in AND tramite $and.
+func appendLogicalGroup(filter bson.M, group *logicalGroup) {
+	if len(group.members) == 0 {
+		return
 	}
-
-	return filter, nil
+	if group.operator == "$and" {
+		previous, _ := filter["$and"].(bson.A)
+		filter["$and"] = append(previous, group.members...)
+		return
+	}
+	if _, ok := filter[group.operator]; !ok {
+		filter[group.operator] = group.members
+		return
+	}
+	previous, _ := filter["$and"].(bson.A)
+	filter["$and"] = append(previous, bson.M{group.operator: group.members})
 }
 
 func handleSimpleOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -135,7 +291,7 @@ func handleStartsWithOperator(operator string, fieldValue interface{}) (bson.M,
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": "^" + strValue}, nil
+	return bson.M{"$regex": "^" + regexp.QuoteMeta(strValue)}, nil
 }
 
 func handleIStartsWithOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -143,7 +299,7 @@ func handleIStartsWithOperator(operator string, fieldValue interface{}) (bson.M,
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": bson.Regex{Pattern: "^" + strValue, Options: "i"}}, nil
+	return bson.M{"$regex": bson.Regex{Pattern: "^" + regexp.QuoteMeta(strValue), Options: "i"}}, nil
 }
 
 func handleEndsWithOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -151,7 +307,7 @@ func handleEndsWithOperator(operator string, fieldValue interface{}) (bson.M, er
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": strValue + "$"}, nil
+	return bson.M{"$regex": regexp.QuoteMeta(strValue) + "$"}, nil
 }
 
 func handleIEndsWithOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -159,7 +315,7 @@ func handleIEndsWithOperator(operator string, fieldValue interface{}) (bson.M, e
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": bson.Regex{Pattern: strValue + "$", Options: "i"}}, nil
+	return bson.M{"$regex": bson.Regex{Pattern: regexp.QuoteMeta(strValue) + "$", Options: "i"}}, nil
 }
 
 func handleContainsOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -167,7 +323,7 @@ func handleContainsOperator(operator string, fieldValue interface{}) (bson.M, er
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": strValue}, nil
+	return bson.M{"$regex": regexp.QuoteMeta(strValue)}, nil
 }
 
 func handleIContainsOperator(operator string, fieldValue interface{}) (bson.M, error) {
@@ -175,9 +331,18 @@ func handleIContainsOperator(operator string, fieldValue interface{}) (bson.M, e
 	if !ok {
 		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
 	}
-	return bson.M{"$regex": bson.Regex{Pattern: strValue, Options: "i"}}, nil
+	return bson.M{"$regex": bson.Regex{Pattern: regexp.QuoteMeta(strValue), Options: "i"}}, nil
 }
 
+func handleIEqualsOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	strValue, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo stringa", operator)
+	}
+	return bson.M{"$regex": bson.Regex{Pattern: "^" + regexp.QuoteMeta(strValue) + "$", Options: "i"}}, nil
+}
+
+// handleRegexOperator usa il valore come espressione regolare, senza escape.
 func handleRegexOperator(operator string, fieldValue interface{}) (bson.M, error) {
 	strValue, ok := fieldValue.(string)
 	if !ok {
@@ -198,6 +363,78 @@ func handleSizeOperator(operator string, fieldValue interface{}) (bson.M, error)
 	}
 }
 
+// handleElemMatchOperator costruisce il filtro degli elementi di un array di sotto-documenti.
+// Il valore deve essere una struct taggata: i percorsi dei suoi campi sono relativi all'elemento.
+func handleElemMatchOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	val := reflect.ValueOf(fieldValue)
+	if val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo struct", operator)
+	}
+	plan, err := getFilterPlan(val.Type())
+	if err != nil {
+		return nil, err
+	}
+	elemFilter, err := plan.build(val)
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{operator: elemFilter}, nil
+}
+
+// handleBetweenOperator accetta una slice o un array di due elementi [min, max], estremi inclusi.
+func handleBetweenOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	val := reflect.ValueOf(fieldValue)
+	if (val.Kind() != reflect.Slice && val.Kind() != reflect.Array) || val.Len() != 2 {
+		return nil, fmt.Errorf("operatore '%s' richiede una slice di due elementi", operator)
+	}
+	return bson.M{"$gte": val.Index(0).Interface(), "$lte": val.Index(1).Interface()}, nil
+}
+
+// handleNotOperator nega un'espressione di operatori (bson.M o bson.D) o una regex.
+// Una stringa viene interpretata come pattern di regex grezzo.
+func handleNotOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	switch v := fieldValue.(type) {
+	case bson.M, bson.D, bson.Regex:
+		return bson.M{operator: v}, nil
+	case string:
+		return bson.M{operator: bson.Regex{Pattern: v}}, nil
+	default:
+		return nil, fmt.Errorf("operatore '%s' richiede un'espressione bson o una regex", operator)
+	}
+}
+
+// handleModOperator accetta una slice o un array di due interi [divisore, resto].
+func handleModOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	val := reflect.ValueOf(fieldValue)
+	if (val.Kind() != reflect.Slice && val.Kind() != reflect.Array) || val.Len() != 2 {
+		return nil, fmt.Errorf("operatore '%s' richiede una slice di due interi", operator)
+	}
+	args := make(bson.A, 0, 2)
+	for i := 0; i < 2; i++ {
+		switch item := val.Index(i); item.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			args = append(args, item.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			args = append(args, int64(item.Uint()))
+		default:
+			return nil, fmt.Errorf("operatore '%s' richiede una slice di due interi", operator)
+		}
+	}
+	return bson.M{operator: args}, nil
+}
+
+// handleRangeOperator espande un Range nelle condizioni $gt/$gte/$lt/$lte dei suoi estremi.
+func handleRangeOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	r, ok := fieldValue.(rangeCondition)
+	if !ok {
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo Range", operator)
+	}
+	return r.rangeCondition(), nil
+}
+
 func FilterToJson(filter any) string {
 
 	mappa := bson.M{"filter": filter}
@@ -0,0 +1,688 @@
+package coremongo
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testNameOrEmail struct {
+	Name  string `field:"name" operator:"$icontains" omitempty:"true"`
+	Email string `field:"email" operator:"$icontains" omitempty:"true"`
+}
+
+type testGroupFilter struct {
+	Status string          `field:"status" operator:"$eq" omitempty:"true"`
+	Name   string          `field:"name" operator:"$eq" omitempty:"true" group:"$or:search"`
+	Email  string          `field:"email" operator:"$eq" omitempty:"true" group:"$or:search"`
+	Type   string          `field:"type" operator:"$eq" omitempty:"true" group:"$or:type"`
+	Kind   string          `field:"kind" operator:"$eq" omitempty:"true" group:"$or:type"`
+	Banned []string        `field:"tags" operator:"$in" omitempty:"true" group:"$nor"`
+	Nested testNameOrEmail `group:"$or:search"`
+}
+
+func (testGroupFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+// assertFilterJSON confronta il filtro generato con il json atteso, indipendentemente dall'ordine delle chiavi.
+func assertFilterJSON(t *testing.T, filter bson.M, want string) {
+	t.Helper()
+	got, err := bson.MarshalExtJSON(filter, false, false)
+	if err != nil {
+		t.Fatalf("marshal filtro: %v", err)
+	}
+	var gotObj, wantObj interface{}
+	if err := json.Unmarshal(got, &gotObj); err != nil {
+		t.Fatalf("unmarshal filtro generato: %v\njson: %s", err, got)
+	}
+	if err := json.Unmarshal([]byte(want), &wantObj); err != nil {
+		t.Fatalf("unmarshal json atteso: %v", err)
+	}
+	if !reflect.DeepEqual(gotObj, wantObj) {
+		gotPretty, _ := json.MarshalIndent(gotObj, "", "  ")
+		wantPretty, _ := json.MarshalIndent(wantObj, "", "  ")
+		t.Errorf("filtro non corrisponde\n--- got ---\n%s\n--- want ---\n%s", gotPretty, wantPretty)
+	}
+}
+
+func TestBuildFilterLogicalGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter testGroupFilter
+		want   string
+	}{
+		{
+			name:   "nessun campo valorizzato",
+			filter: testGroupFilter{},
+			want:   `{}`,
+		},
+		{
+			name:   "or semplice",
+			filter: testGroupFilter{Status: "A", Name: "x", Email: "y"},
+			want:   `{"status":{"$eq":"A"},"$or":[{"name":{"$eq":"x"}},{"email":{"$eq":"y"}}]}`,
+		},
+		{
+			name:   "due gruppi or in and",
+			filter: testGroupFilter{Name: "x", Type: "t", Kind: "k"},
+			want:   `{"$or":[{"name":{"$eq":"x"}}],"$and":[{"$or":[{"type":{"$eq":"t"}},{"kind":{"$eq":"k"}}]}]}`,
+		},
+		{
+			name:   "struct annidata come membro del gruppo",
+			filter: testGroupFilter{Name: "x", Nested: testNameOrEmail{Name: "a", Email: "b"}},
+			want:   `{"$or":[{"name":{"$eq":"x"}},{"name":{"$regex":{"$regularExpression":{"pattern":"a","options":"i"}}},"email":{"$regex":{"$regularExpression":{"pattern":"b","options":"i"}}}}]}`,
+		},
+		{
+			name:   "nor",
+			filter: testGroupFilter{Banned: []string{"a"}},
+			want:   `{"$nor":[{"tags":{"$in":["a"]}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+type testBadGroupFilter struct {
+	Name string `field:"name" operator:"$eq" group:"$xor"`
+}
+
+func (testBadGroupFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestBuildFilterUnknownLogicalOperator(t *testing.T) {
+	if _, err := buildFilter(testBadGroupFilter{Name: "x"}); err == nil {
+		t.Fatal("atteso errore per operatore logico non supportato")
+	}
+}
+
+type testAddress struct {
+	City string  `field:"city" operator:"$eq" omitempty:"true"`
+	Zip  *string `field:"zip" operator:"$eq"`
+}
+
+type testBaseFilter struct {
+	Tenant string `field:"tenant" operator:"$eq" omitempty:"true"`
+}
+
+type testNestedFilter struct {
+	testBaseFilter
+	Address  testAddress  `field:"address"`
+	Billing  *testAddress `field:"billing"`
+	Active   *bool        `field:"active" operator:"$eq"`
+	internal string       `field:"internal" operator:"$eq"`
+}
+
+func (testNestedFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestBuildFilterNestedStructs(t *testing.T) {
+	active := false
+	zip := "00100"
+	tests := []struct {
+		name   string
+		filter testNestedFilter
+		want   string
+	}{
+		{
+			name:   "puntatori nil e campi non esportati ignorati",
+			filter: testNestedFilter{internal: "x"},
+			want:   `{}`,
+		},
+		{
+			name:   "percorsi puntati",
+			filter: testNestedFilter{Address: testAddress{City: "Roma", Zip: &zip}},
+			want:   `{"address.city":{"$eq":"Roma"},"address.zip":{"$eq":"00100"}}`,
+		},
+		{
+			name:   "puntatore a struct e puntatore a valore zero",
+			filter: testNestedFilter{Billing: &testAddress{City: "Milano"}, Active: &active},
+			want:   `{"billing.city":{"$eq":"Milano"},"active":{"$eq":false}}`,
+		},
+		{
+			name:   "struct embedded appiattita",
+			filter: testNestedFilter{testBaseFilter: testBaseFilter{Tenant: "t1"}},
+			want:   `{"tenant":{"$eq":"t1"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+type testOrderLine struct {
+	Sku string `field:"sku" operator:"$eq" omitempty:"true"`
+	Qty int    `field:"qty" operator:"$gt" omitempty:"true"`
+}
+
+type testOrderFilter struct {
+	Lines   testOrderLine  `field:"lines" operator:"$elemMatch" omitempty:"true"`
+	History *testOrderLine `field:"history" operator:"$elemMatch"`
+}
+
+func (testOrderFilter) GetFilterCollectionName(ctx context.Context) string { return "orders" }
+
+func TestBuildFilterElemMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter testOrderFilter
+		want   string
+	}{
+		{
+			name:   "struct vuota omessa",
+			filter: testOrderFilter{},
+			want:   `{}`,
+		},
+		{
+			name:   "elemMatch con piu condizioni",
+			filter: testOrderFilter{Lines: testOrderLine{Sku: "X", Qty: 3}},
+			want:   `{"lines":{"$elemMatch":{"sku":{"$eq":"X"},"qty":{"$gt":3}}}}`,
+		},
+		{
+			name:   "elemMatch da puntatore",
+			filter: testOrderFilter{History: &testOrderLine{Sku: "Y"}},
+			want:   `{"history":{"$elemMatch":{"sku":{"$eq":"Y"}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+type testUnknownOperatorFilter struct {
+	Name string `field:"name" operator:"$equal"`
+}
+
+func (testUnknownOperatorFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testBadElemMatchFilter struct {
+	Lines string `field:"lines" operator:"$elemMatch"`
+}
+
+func (testBadElemMatchFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testRecursiveFilter struct {
+	Name   string               `field:"name" operator:"$eq" omitempty:"true"`
+	Parent *testRecursiveFilter `field:"parent"`
+}
+
+func (testRecursiveFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestValidateFilterType(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func() error
+		wantErr  bool
+	}{
+		{name: "gruppi", validate: ValidateFilterType[testGroupFilter]},
+		{name: "struct annidate", validate: ValidateFilterType[testNestedFilter]},
+		{name: "puntatore", validate: ValidateFilterType[*testOrderFilter]},
+		{name: "operatore sconosciuto", validate: ValidateFilterType[testUnknownOperatorFilter], wantErr: true},
+		{name: "operatore logico sconosciuto", validate: ValidateFilterType[testBadGroupFilter], wantErr: true},
+		{name: "elemMatch non struct", validate: ValidateFilterType[testBadElemMatchFilter], wantErr: true},
+		{name: "tipo ricorsivo", validate: ValidateFilterType[testRecursiveFilter], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("errore atteso %v, ottenuto %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFilterPlanCache(t *testing.T) {
+	typ := reflect.TypeFor[testOrderFilter]()
+	first, err := getFilterPlan(typ)
+	if err != nil {
+		t.Fatalf("getFilterPlan: %v", err)
+	}
+	second, err := getFilterPlan(typ)
+	if err != nil {
+		t.Fatalf("getFilterPlan: %v", err)
+	}
+	if first != second {
+		t.Error("il piano compilato non è stato riutilizzato")
+	}
+}
+
+func TestStringOperatorsEscaping(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    string
+		want     string
+	}{
+		{operator: "$contains", value: "a.b", want: `{"$regex":"a\\.b"}`},
+		{operator: "$contains", value: "(", want: `{"$regex":"\\("}`},
+		{operator: "$startswith", value: "a+b", want: `{"$regex":"^a\\+b"}`},
+		{operator: "$endswith", value: "x$", want: `{"$regex":"x\\$$"}`},
+		{operator: "$icontains", value: "[a]", want: `{"$regex":{"$regularExpression":{"pattern":"\\[a\\]","options":"i"}}}`},
+		{operator: "$istartswith", value: "a*", want: `{"$regex":{"$regularExpression":{"pattern":"^a\\*","options":"i"}}}`},
+		{operator: "$iendswith", value: "?", want: `{"$regex":{"$regularExpression":{"pattern":"\\?$","options":"i"}}}`},
+		{operator: "$ieq", value: "a.b", want: `{"$regex":{"$regularExpression":{"pattern":"^a\\.b$","options":"i"}}}`},
+		{operator: "$regex", value: "^a.b", want: `{"$regex":"^a.b"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.operator+" "+tt.value, func(t *testing.T) {
+			got, err := operatorHandlers[tt.operator](tt.operator, tt.value)
+			if err != nil {
+				t.Fatalf("handler: %v", err)
+			}
+			assertFilterJSON(t, got, tt.want)
+		})
+	}
+}
+
+type testCollationFilter struct {
+	Name  string `field:"name" operator:"$ieq" collation:"it" omitempty:"true"`
+	Email string `field:"email" operator:"$ieq" omitempty:"true"`
+}
+
+func (testCollationFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testBadCollationFilter struct {
+	Name string `field:"name" operator:"$contains" collation:"it"`
+}
+
+func (testBadCollationFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testConflictCollationFilter struct {
+	Name  string `field:"name" operator:"$eq" collation:"it"`
+	Email string `field:"email" operator:"$eq" collation:"en"`
+}
+
+func (testConflictCollationFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testCollationPtrFilter struct {
+	Name *string `field:"name" operator:"$eq" collation:"it"`
+}
+
+func (testCollationPtrFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+type testCollationElemFilter struct {
+	Lines *testCollationFilter `field:"lines" operator:"$elemMatch"`
+}
+
+func (testCollationElemFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestBuildFilterCollation(t *testing.T) {
+	filter := testCollationFilter{Name: "Rossi", Email: "A@B.it"}
+	got, err := buildFilter(filter)
+	if err != nil {
+		t.Fatalf("buildFilter: %v", err)
+	}
+	assertFilterJSON(t, got, `{"name":{"$eq":"Rossi"},"email":{"$regex":{"$regularExpression":{"pattern":"^A@B\\.it$","options":"i"}}}}`)
+
+	collation := filterCollation(filter)
+	if collation == nil || collation.Locale != "it" || collation.Strength != 2 {
+		t.Errorf("collation inattesa: %+v", collation)
+	}
+	if c := filterCollation(testGroupFilter{}); c != nil {
+		t.Errorf("collation non attesa: %+v", c)
+	}
+	// Il campo con la collation omesso perché vuoto non la richiede
+	if c := filterCollation(testCollationFilter{Email: "A@B.it"}); c != nil {
+		t.Errorf("collation non attesa per campo omesso: %+v", c)
+	}
+	if c := filterCollation(testCollationPtrFilter{}); c != nil {
+		t.Errorf("collation non attesa per puntatore nil: %+v", c)
+	}
+	name := "Rossi"
+	if c := filterCollation(testCollationPtrFilter{Name: &name}); c == nil {
+		t.Error("collation attesa per il campo valorizzato")
+	}
+	if c := filterCollation(QueryFrom(testCollationElemFilter{}, Where("stato").Eq("A"))); c != nil {
+		t.Errorf("collation non attesa per $elemMatch senza condizioni con collation: %+v", c)
+	}
+	if c := filterCollation(testCollationElemFilter{Lines: &testCollationFilter{Name: "x"}}); c == nil {
+		t.Error("collation attesa per $elemMatch con campo valorizzato")
+	}
+	if err := ValidateFilterType[testBadCollationFilter](); err == nil {
+		t.Error("atteso errore per collation con operatore non di uguaglianza")
+	}
+	if err := ValidateFilterType[testConflictCollationFilter](); err == nil {
+		t.Error("atteso errore per collation in conflitto")
+	}
+}
+
+type testCustomOperatorFilter struct {
+	Amount []int          `field:"amount" operator:"$between" omitempty:"true"`
+	Code   string         `field:"code" operator:"$not" omitempty:"true"`
+	Even   []int          `field:"n" operator:"$mod" omitempty:"true"`
+	Kind   string         `field:"kind" operator:"$testType" omitempty:"true"`
+	Search string         `field:"search" operator:"$testSearch" omitempty:"true"`
+	Other  map[string]int `field:"other" operator:"$not" omitempty:"true"`
+}
+
+func (testCustomOperatorFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+// unregisterTestOperators rimuove a fine test gli operatori registrati, così che il test possa
+// essere ripetuto (go test -count=2) senza l'errore di operatore già registrato.
+func unregisterTestOperators(t *testing.T, operators ...string) {
+	t.Cleanup(func() {
+		operatorsMu.Lock()
+		defer operatorsMu.Unlock()
+		for _, operator := range operators {
+			delete(operatorHandlers, operator)
+			delete(topLevelOperators, operator)
+		}
+	})
+}
+
+func TestRegisterOperator(t *testing.T) {
+	unregisterTestOperators(t, "$testType", "$testSearch")
+	err := RegisterOperator("$testType", func(operator string, fieldValue interface{}) (bson.M, error) {
+		return bson.M{"$type": fieldValue}, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterOperator: %v", err)
+	}
+	err = RegisterTopLevelOperator("$testSearch", func(operator string, fieldValue interface{}) (bson.M, error) {
+		return bson.M{"$text": bson.M{"$search": fieldValue}}, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterTopLevelOperator: %v", err)
+	}
+	if err := RegisterOperator("$eq", handleSimpleOperator); err == nil {
+		t.Error("atteso errore per operatore già registrato")
+	}
+
+	tests := []struct {
+		name    string
+		filter  testCustomOperatorFilter
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "between",
+			filter: testCustomOperatorFilter{Amount: []int{10, 20}},
+			want:   `{"amount":{"$gte":10,"$lte":20}}`,
+		},
+		{
+			name:    "between con un solo elemento",
+			filter:  testCustomOperatorFilter{Amount: []int{10}},
+			wantErr: true,
+		},
+		{
+			name:   "not regex",
+			filter: testCustomOperatorFilter{Code: "^X"},
+			want:   `{"code":{"$not":{"$regularExpression":{"pattern":"^X","options":""}}}}`,
+		},
+		{
+			name:    "not con valore non supportato",
+			filter:  testCustomOperatorFilter{Other: map[string]int{"a": 1}},
+			wantErr: true,
+		},
+		{
+			name:   "mod",
+			filter: testCustomOperatorFilter{Even: []int{2, 0}},
+			want:   `{"n":{"$mod":[2,0]}}`,
+		},
+		{
+			name:   "operatori personalizzati",
+			filter: testCustomOperatorFilter{Kind: "string", Search: "rossi"},
+			want:   `{"kind":{"$type":"string"},"$text":{"$search":"rossi"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("atteso errore")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+type testRangeFilter struct {
+	Created Range[time.Time] `field:"createdAt"`
+	Amount  *Range[float64]  `field:"amount"`
+	Qty     Range[int]       `field:"qty" operator:"$range"`
+	Status  string           `field:"status" operator:"$eq" omitempty:"true"`
+	Extra   string           `field:"status" operator:"$testRaw" omitempty:"true"`
+}
+
+func (testRangeFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestBuildFilterRange(t *testing.T) {
+	unregisterTestOperators(t, "$testRaw")
+	if err := RegisterOperator("$testRaw", func(operator string, fieldValue interface{}) (bson.M, error) {
+		return bson.M{"$testRaw": fieldValue}, nil
+	}); err != nil {
+		t.Fatalf("RegisterOperator: %v", err)
+	}
+	rome := time.FixedZone("CET", 3600)
+	from := time.Date(2026, 1, 1, 1, 0, 0, 0, rome)
+	to := time.Date(2026, 2, 1, 1, 0, 0, 0, rome)
+	minAmount := 10.5
+
+	tests := []struct {
+		name   string
+		filter testRangeFilter
+		want   string
+	}{
+		{
+			name:   "range vuoti omessi",
+			filter: testRangeFilter{Amount: &Range[float64]{}},
+			want:   `{}`,
+		},
+		{
+			name:   "date normalizzate in UTC",
+			filter: testRangeFilter{Created: NewRange(from, to)},
+			want:   `{"createdAt":{"$gte":{"$date":"2026-01-01T00:00:00Z"},"$lt":{"$date":"2026-02-01T00:00:00Z"}}}`,
+		},
+		{
+			name:   "estremi esclusivi e inclusivi",
+			filter: testRangeFilter{Amount: &Range[float64]{From: &minAmount, FromExclusive: true}, Qty: Range[int]{To: new(int), ToInclusive: true}},
+			want:   `{"amount":{"$gt":10.5},"qty":{"$lte":0}}`,
+		},
+		{
+			name:   "condizioni unite sullo stesso campo",
+			filter: testRangeFilter{Status: "A", Extra: "B"},
+			want:   `{"status":{"$eq":"A","$testRaw":"B"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+func TestMergeClauseNotMergeable(t *testing.T) {
+	filter := bson.M{"$where": "this.a > 1"}
+	if err := mergeClause(filter, bson.M{"$where": "this.b > 1"}); err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, filter, `{"$where":"this.a > 1","$and":[{"$where":"this.b > 1"}]}`)
+
+	filter = bson.M{"$or": bson.A{bson.M{"a": 1}}}
+	for _, value := range []any{[]any{bson.M{"b": 1}}, bson.D{{Key: "b", Value: 1}}} {
+		if err := mergeClause(filter, bson.M{"$or": value}); err == nil {
+			t.Errorf("atteso errore per $or di tipo %T", value)
+		}
+	}
+}
+
+type testTextFilter struct {
+	Text   TextSearch `operator:"$text"`
+	Status string     `field:"status" operator:"$eq" omitempty:"true"`
+}
+
+func (testTextFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestBuildFilterTextSearch(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter testTextFilter
+		want   string
+		text   bool
+	}{
+		{
+			name:   "ricerca vuota omessa",
+			filter: testTextFilter{Status: "A"},
+			want:   `{"status":{"$eq":"A"}}`,
+		},
+		{
+			name:   "ricerca con lingua",
+			filter: testTextFilter{Text: TextSearch{Search: "mario rossi", Language: "italian", DiacriticSensitive: true}},
+			want:   `{"$text":{"$search":"mario rossi","$language":"italian","$diacriticSensitive":true}}`,
+			text:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+			if hasTextSearch(filter) != tt.text {
+				t.Errorf("hasTextSearch atteso %v", tt.text)
+			}
+		})
+	}
+}
+
+type testGroupTextFilter struct {
+	Text   string `operator:"$text" group:"$or:ricerca" omitempty:"true"`
+	Status string `field:"status" operator:"$eq" group:"$or:ricerca" omitempty:"true"`
+}
+
+func (testGroupTextFilter) GetFilterCollectionName(ctx context.Context) string { return "test" }
+
+func TestHasTextSearchNested(t *testing.T) {
+	query := QueryFrom(testTextFilter{Text: TextSearch{Search: "rossi"}}, Where("status").Eq("A"))
+	filter, err := buildFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := filter["$text"]; ok || !hasTextSearch(filter) {
+		t.Errorf("$text dentro $and non riconosciuto: %s", FilterToJson(filter))
+	}
+	filter, err = buildFilter(testGroupTextFilter{Text: "rossi", Status: "A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasTextSearch(filter) {
+		t.Errorf("$text dentro $or non riconosciuto: %s", FilterToJson(filter))
+	}
+	if hasTextSearch(bson.M{"$and": bson.A{bson.D{{Key: "$or", Value: bson.A{bson.M{"a": 1}}}}}}) {
+		t.Error("ricerca full-text non attesa")
+	}
+	if !hasTextSearch(bson.M{"$nor": bson.A{bson.D{{Key: "$and", Value: bson.A{bson.M{"$text": bson.M{"$search": "x"}}}}}}}) {
+		t.Error("$text annidato in bson.D non riconosciuto")
+	}
+}
+
+type testGeoFilter struct {
+	Near       *GeoNear        `field:"location" operator:"$near"`
+	Box        GeoBox          `field:"location" operator:"$geoWithin"`
+	Area       GeoPolygon      `field:"area" operator:"$geoWithin"`
+	Circle     GeoCenterSphere `field:"legacy" operator:"$geoWithin"`
+	Intersects GeoPoint        `field:"zone" operator:"$geoIntersects"`
+}
+
+func (testGeoFilter) GetFilterCollectionName(ctx context.Context) string { return "branches" }
+
+func TestBuildFilterGeo(t *testing.T) {
+	square := NewGeoPolygon([][2]float64{{0, 0}, {0, 1}, {1, 1}, {1, 0}, {0, 0}})
+	tests := []struct {
+		name   string
+		filter testGeoFilter
+		want   string
+	}{
+		{
+			name:   "valori zero omessi",
+			filter: testGeoFilter{Near: &GeoNear{}},
+			want:   `{}`,
+		},
+		{
+			name:   "near con distanza",
+			filter: testGeoFilter{Near: &GeoNear{Point: NewGeoPoint(12.5, 41.9), MaxDistance: 500}},
+			want:   `{"location":{"$near":{"$geometry":{"type":"Point","coordinates":[12.5,41.9]},"$maxDistance":500}}}`,
+		},
+		{
+			name:   "geoWithin box e polygon",
+			filter: testGeoFilter{Box: GeoBox{BottomLeft: [2]float64{0, 0}, UpperRight: [2]float64{2, 2}}, Area: square},
+			want:   `{"location":{"$geoWithin":{"$box":[[0,0],[2,2]]}},"area":{"$geoWithin":{"$geometry":{"type":"Polygon","coordinates":[[[0,0],[0,1],[1,1],[1,0],[0,0]]]}}}}`,
+		},
+		{
+			name:   "geoWithin centerSphere",
+			filter: testGeoFilter{Circle: GeoCenterSphere{Center: [2]float64{12, 41}, Radius: 0.5}},
+			want:   `{"legacy":{"$geoWithin":{"$centerSphere":[[12,41],0.5]}}}`,
+		},
+		{
+			name:   "geoIntersects",
+			filter: testGeoFilter{Intersects: NewGeoPoint(1, 2)},
+			want:   `{"zone":{"$geoIntersects":{"$geometry":{"type":"Point","coordinates":[1,2]}}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+func TestCountFilterNear(t *testing.T) {
+	filter, err := buildFilter(testGeoFilter{
+		Near: &GeoNear{Point: NewGeoPoint(12.5, 41.9), MinDistance: 3189.05, MaxDistance: 6378.1},
+		Box:  GeoBox{BottomLeft: [2]float64{0, 0}, UpperRight: [2]float64{20, 50}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := countFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, count, `{"location":{"$geoWithin":{"$box":[[0,0],[20,50]]}},"$and":[`+
+		`{"location":{"$geoWithin":{"$centerSphere":[[12.5,41.9],0.001]}}},`+
+		`{"$nor":[{"location":{"$geoWithin":{"$centerSphere":[[12.5,41.9],0.0005]}}}]}]}`)
+
+	grouped := bson.M{"$or": bson.A{bson.M{"location": bson.M{"$near": bson.M{"$geometry": NewGeoPoint(1, 2)}}}, bson.M{"a": 1}}}
+	count, err = countFilter(grouped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, count, `{"$or":[{"$and":[{"location":{"$exists":true}}]},{"a":1}]}`)
+
+	if _, err := countFilter(bson.M{"location": bson.M{"$nearSphere": bson.A{1, 2}}}); err == nil {
+		t.Error("atteso errore per $nearSphere in coordinate legacy")
+	}
+}
@@ -0,0 +1,298 @@
+package coremongo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var rangeConditionType = reflect.TypeFor[rangeCondition]()
+
+// filterPlans contiene i piani compilati delle struct filtro, indicizzati per reflect.Type.
+var filterPlans sync.Map // reflect.Type -> *filterPlan
+
+// filterPlan è la forma compilata di una struct filtro: i tag vengono letti e validati
+// una sola volta per tipo, la costruzione del filtro legge solo i valori dei campi.
+type filterPlan struct {
+	fields []*fieldPlan
+	// collation è il locale richiesto dal tag `collation` di uno dei campi
+	collation string
+}
+
+// collationOperators sono gli operatori di uguaglianza che ammettono il tag `collation`.
+var collationOperators = map[string]bool{
+	"$eq":  true,
+	"$ne":  true,
+	"$in":  true,
+	"$nin": true,
+	"$ieq": true,
+}
+
+// fieldPlan descrive un campo della struct filtro.
+type fieldPlan struct {
+	index     int
+	name      string
+	path      string
+	operator  string
+	handler   OperatorHandler
+	topLevel  bool
+	group     string
+	omitEmpty bool
+	pointer   bool
+	// collation indica che la condizione del campo richiede la collation del piano
+	collation bool
+	// nested è valorizzato per le struct annidate o embedded
+	nested *filterPlan
+	// elem è il piano della struct di $elemMatch
+	elem *filterPlan
+}
+
+// ValidateFilterType compila e valida i tag della struct filtro T.
+// Può essere invocata all'avvio dell'applicazione o in un test per intercettare
+// operatori o gruppi non supportati prima della prima query.
+func ValidateFilterType[T IFilter]() error {
+	typ := reflect.TypeFor[T]()
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("input non è una struct")
+	}
+	_, err := getFilterPlan(typ)
+	return err
+}
+
+// getFilterPlan restituisce il piano compilato del tipo, compilandolo alla prima richiesta.
+// I piani non validi non vengono memorizzati.
+func getFilterPlan(typ reflect.Type) (*filterPlan, error) {
+	if plan, ok := filterPlans.Load(typ); ok {
+		return plan.(*filterPlan), nil
+	}
+	plan, err := compileFilterPlan(typ, "", map[reflect.Type]bool{})
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := filterPlans.LoadOrStore(typ, plan)
+	return actual.(*filterPlan), nil
+}
+
+// compileFilterPlan legge i tag della struct. prefix è il percorso puntato del documento
+// annidato (vuoto al primo livello), visiting protegge dai tipi ricorsivi.
+func compileFilterPlan(typ reflect.Type, prefix string, visiting map[reflect.Type]bool) (*filterPlan, error) {
+	if visiting[typ] {
+		return nil, fmt.Errorf("tipo ricorsivo '%s' non supportato", typ)
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	plan := &filterPlan{fields: make([]*fieldPlan, 0, typ.NumField())}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		// Ottieni i tag 'field', 'operator' e 'group'
+		fieldNameTag := field.Tag.Get("field")
+		operatorTag := field.Tag.Get("operator")
+		groupTag := field.Tag.Get("group")
+
+		// I campi non esportati non sono leggibili tramite reflection,
+		// ad eccezione dei campi esportati di una struct embedded
+		if !field.IsExported() && (!field.Anonymous || operatorTag != "" || !isStructType(field.Type)) {
+			continue
+		}
+
+		fieldType := field.Type
+		_, omitEmpty := field.Tag.Lookup("omitempty")
+		fp := &fieldPlan{
+			index:     i,
+			name:      field.Name,
+			group:     groupTag,
+			omitEmpty: omitEmpty,
+			pointer:   fieldType.Kind() == reflect.Ptr,
+		}
+		if fp.pointer {
+			fieldType = fieldType.Elem()
+		}
+		// I Range possono omettere il tag 'operator': vengono espansi in una condizione di intervallo
+		if operatorTag == "" && fieldNameTag != "" && fieldType.Implements(rangeConditionType) {
+			operatorTag = "$range"
+		}
+
+		switch {
+		case operatorTag != "" && (fieldNameTag != "" || topLevelOperator(operatorTag)):
+			// Gli operatori di primo livello (es. $text) non richiedono il tag 'field'
+			fp.path = prefix + fieldNameTag
+			fp.operator = operatorTag
+			handler, topLevel, ok := lookupOperator(operatorTag)
+			if !ok {
+				return nil, fmt.Errorf("operatore '%s' non supportato per il campo '%s'", operatorTag, fp.path)
+			}
+			fp.handler = handler
+			fp.topLevel = topLevel
+			if operatorTag == "$elemMatch" {
+				if fieldType.Kind() != reflect.Struct {
+					return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo struct per il campo '%s'", operatorTag, fp.path)
+				}
+				// Il piano della struct dell'elemento viene compilato e validato con quello del campo
+				elemPlan, err := compileFilterPlan(fieldType, "", visiting)
+				if err != nil {
+					return nil, fmt.Errorf("campo '%s': %w", fp.path, err)
+				}
+				if err := plan.setCollation(elemPlan.collation); err != nil {
+					return nil, err
+				}
+				fp.elem = elemPlan
+			}
+			if collationTag := field.Tag.Get("collation"); collationTag != "" {
+				if !collationOperators[operatorTag] {
+					return nil, fmt.Errorf("tag collation non supportato con l'operatore '%s' per il campo '%s'", operatorTag, fp.path)
+				}
+				// Con la collation il confronto case-insensitive è fatto dal server: $ieq diventa $eq
+				if operatorTag == "$ieq" {
+					fp.operator = "$eq"
+					fp.handler = handleSimpleOperator
+				}
+				if err := plan.setCollation(collationTag); err != nil {
+					return nil, err
+				}
+				fp.collation = true
+			}
+		case fieldType.Kind() == reflect.Struct && (fieldNameTag != "" || groupTag != "" || field.Anonymous):
+			// Struct annidata o embedded: il tag 'field' diventa il prefisso dei suoi campi
+			subPrefix := prefix
+			if fieldNameTag != "" {
+				subPrefix = prefix + fieldNameTag + "."
+			}
+			nested, err := compileFilterPlan(fieldType, subPrefix, visiting)
+			if err != nil {
+				return nil, err
+			}
+			fp.nested = nested
+			if err := plan.setCollation(nested.collation); err != nil {
+				return nil, err
+			}
+		default:
+			// Se mancano i tag 'field' o 'operator', salta il campo
+			continue
+		}
+
+		if groupTag != "" {
+			operator, _, _ := strings.Cut(groupTag, ":")
+			if !logicalOperators[operator] {
+				return nil, fmt.Errorf("operatore logico '%s' non supportato per il campo '%s'", operator, field.Name)
+			}
+		}
+		plan.fields = append(plan.fields, fp)
+	}
+	return plan, nil
+}
+
+// setCollation registra il locale richiesto da un campo; la collation si applica
+// all'intera query, quindi locali diversi nella stessa struct non sono ammessi.
+func (p *filterPlan) setCollation(locale string) error {
+	if locale == "" {
+		return nil
+	}
+	if p.collation != "" && p.collation != locale {
+		return fmt.Errorf("collation '%s' in conflitto con '%s'", locale, p.collation)
+	}
+	p.collation = locale
+	return nil
+}
+
+// build costruisce il filtro a partire dal valore della struct.
+// I campi senza gruppo sono messi in AND, quelli con il tag `group` vengono raccolti
+// nel rispettivo gruppo logico e aggiunti al filtro al termine dell'iterazione.
+func (p *filterPlan) build(val reflect.Value) (bson.M, error) {
+	filter, _, err := p.buildWithCollation(val)
+	return filter, err
+}
+
+// buildWithCollation costruisce il filtro come build e indica se contiene almeno una condizione
+// di un campo con il tag `collation`: i campi omessi o non valorizzati non la richiedono.
+func (p *filterPlan) buildWithCollation(val reflect.Value) (bson.M, bool, error) {
+	filter := bson.M{}
+	groups := make([]*logicalGroup, 0)
+	groupsByName := make(map[string]*logicalGroup)
+	usesCollation := false
+
+	for _, fp := range p.fields {
+		valField := val.Field(fp.index)
+		if fp.omitEmpty && valField.IsZero() {
+			continue
+		}
+		// Un puntatore nil equivale a un campo non valorizzato
+		if fp.pointer {
+			if valField.IsNil() {
+				continue
+			}
+			valField = valField.Elem()
+		}
+
+		var clause bson.M
+		clauseCollation := fp.collation
+		switch {
+		case fp.nested != nil:
+			sub, subCollation, err := fp.nested.buildWithCollation(valField)
+			if err != nil {
+				return nil, false, err
+			}
+			clause, clauseCollation = sub, subCollation
+		case fp.elem != nil:
+			elemFilter, elemCollation, err := fp.elem.buildWithCollation(valField)
+			if err != nil {
+				return nil, false, fmt.Errorf("errore per campo '%s' operatore '%s': %w", fp.path, fp.operator, err)
+			}
+			clause, clauseCollation = bson.M{fp.path: bson.M{fp.operator: elemFilter}}, elemCollation
+		default:
+			opFilter, err := fp.handler(fp.operator, valField.Interface())
+			if err != nil {
+				return nil, false, fmt.Errorf("errore per campo '%s' operatore '%s': %w", fp.path, fp.operator, err)
+			}
+			// Una condizione vuota equivale a un campo non valorizzato (es. Range senza estremi)
+			if len(opFilter) == 0 {
+				continue
+			}
+			clause = bson.M{fp.path: opFilter}
+			// Gli operatori di primo livello restituiscono già la clausola completa
+			if fp.topLevel {
+				clause = opFilter
+			}
+		}
+		if len(clause) == 0 {
+			continue
+		}
+		usesCollation = usesCollation || clauseCollation
+
+		if fp.group == "" {
+			if err := mergeClause(filter, clause); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		group, ok := groupsByName[fp.group]
+		if !ok {
+			operator, _, _ := strings.Cut(fp.group, ":")
+			group = &logicalGroup{operator: operator, members: bson.A{}}
+			groupsByName[fp.group] = group
+			groups = append(groups, group)
+		}
+		group.members = append(group.members, clause)
+	}
+
+	for _, group := range groups {
+		appendLogicalGroup(filter, group)
+	}
+
+	return filter, usesCollation, nil
+}
+
+// isStructType indica se il tipo è una struct o un puntatore a struct.
+func isStructType(typ reflect.Type) bool {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.Kind() == reflect.Struct
+}
@@ -0,0 +1,236 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// FindAndModifyOptions sono le opzioni di FindOneAndUpdate, FindOneAndReplace e FindOneAndDelete.
+// Le tre funzioni non registrano lo storico e restituiscono MON-HISTORY per i documenti IHistory.
+type FindAndModifyOptions struct {
+	// ReturnAfter restituisce il documento dopo la modifica invece di quello precedente
+	// (ignorato da FindOneAndDelete).
+	ReturnAfter bool
+	// Upsert inserisce il documento se nessuno soddisfa il filtro (ignorato da FindOneAndDelete).
+	Upsert bool
+	// Sort sceglie il documento da modificare se più documenti soddisfano il filtro.
+	Sort page.SortRequest
+	// Projection limita i campi restituiti; se nil e T è una vista (IView) si usa la proiezione della vista.
+	Projection Projection
+}
+
+func (o FindAndModifyOptions) projection(view Projection) Projection {
+	if o.Projection != nil {
+		return o.Projection
+	}
+	return view
+}
+
+// checkFindAndModify verifica che T sia registrato e non abbia lo storico: find and modify non legge lo
+// stato precedente del documento, quindi i documenti IHistory vanno scritti con le funzioni di collection.go.
+func checkFindAndModify[T ICollection](ctx context.Context) *core.ApplicationError {
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return errR
+	}
+	if policyOf[T]().history {
+		collection := collectionOf[T](ctx)
+		return core.TechnicalErrorWithCodeAndMessage("MON-HISTORY", fmt.Sprintf("i documenti di %s hanno lo storico e non possono essere scritti con find and modify", collection))
+	}
+	return nil
+}
+
+// FindOneAndUpdate aggiorna in modo atomico il documento che soddisfa il filtro e lo restituisce,
+// prima o dopo la modifica. L'update è un bson.M, una pipeline o un IUpdate; i campi di audit e la
+// versione del documento vengono aggiornati e IBeforeUpdate viene chiamato come in UpdateOne. Se nessun documento soddisfa il filtro
+// restituisce NotFoundError, MON-CONFLICT con un filtro AtVersion; con Upsert e il documento precedente
+// un inserimento restituisce nil senza errore.
+//
+//	job, err := coremongo.FindOneAndUpdate[Job](ctx, ms, &FiltroJob{Stato: "PENDING"},
+//		coremongo.NewUpdate().Set("stato", "RUNNING").CurrentDate("claimedAt"),
+//		coremongo.FindAndModifyOptions{ReturnAfter: true, Sort: page.SortRequest{{Field: "createdAt", Dir: 1}}})
+func FindOneAndUpdate[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, update any, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	if errR := checkFindAndModify[T](ctx); errR != nil {
+		return nil, errR
+	}
+	collection := collectionOf[T](ctx)
+	filterB, doc, errU := findAndModifyUpdate(ctx, collection, policyOf[T](), filter, update)
+	if errU != nil {
+		return nil, errU
+	}
+	return findOneAndUpdate[T](ctx, ms, collection, filter, filterB, doc, fm, hasVersion(filter))
+}
+
+// findAndModifyUpdate restituisce filtro e update di FindOneAndUpdate, preparato come in UpdateOne da
+// policyUpdate.
+func findAndModifyUpdate(ctx context.Context, collection string, policy *documentPolicy, filter IFilter, update any) (bson.M, any, *core.ApplicationError) {
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, nil, core.TechnicalErrorWithError(errB)
+	}
+	doc, errU := policyUpdate(ctx, policy, filter, update)
+	if errU != nil {
+		return nil, nil, errU
+	}
+	return excludeDeleted(collection, filter, filterB), doc, nil
+}
+
+// findOneAndUpdate esegue FindOneAndUpdate con il filtro e l'update già preparati; con versioned il
+// filtro richiede una versione, vedi findAndModifyResult.
+func findOneAndUpdate[T ICollection](ctx context.Context, ms *mongolks.LinkedService, collection string, filter IFilter, filterB bson.M, update any, fm FindAndModifyOptions, versioned bool) (*T, *core.ApplicationError) {
+	opts := options.FindOneAndUpdate().SetUpsert(fm.Upsert).SetCollation(filterCollation(filter))
+	if fm.ReturnAfter {
+		opts.SetReturnDocument(options.After)
+	}
+	if len(fm.Sort) > 0 {
+		opts.SetSort(SortToBson(fm.Sort))
+	}
+	if p := fm.projection(viewProjection[T]()); p != nil {
+		opts.SetProjection(p.bson())
+	}
+	var obj T
+	err := ms.GetCollection(collection, "").FindOneAndUpdate(ctx, filterB, update, opts).Decode(&obj)
+	return findAndModifyResult(ctx, &obj, err, fm, collection, versioned)
+}
+
+// FindOneAndReplace sostituisce in modo atomico il documento che soddisfa il filtro e lo restituisce,
+// prima o dopo la modifica. Come in ReplaceOne viene chiamato IBeforeReplace e un documento Auditable viene sostituito mantenendo
+// createdAt e createdBy, un documento Versioned solo alla versione letta, che viene incrementata (per
+// un documento passato per valore solo sul database); altrimenti viene restituito MON-CONFLICT. Il
+// comportamento con documento assente è quello di FindOneAndUpdate.
+func FindOneAndReplace[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, replacement T, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	if errR := checkFindAndModify[T](ctx); errR != nil {
+		return nil, errR
+	}
+	collection := replacement.GetCollectionName(ctx)
+	filterB, doc, version, errR := findAndModifyReplace(ctx, collection, policyOf[T](), filter, replacement)
+	if errR != nil {
+		return nil, errR
+	}
+	versioned := version != nil || hasVersion(filter)
+	var result *T
+	if pipeline, ok := doc.(mongo.Pipeline); ok {
+		result, errR = findOneAndUpdate[T](ctx, ms, collection, filter, filterB, pipeline, fm, versioned)
+	} else {
+		result, errR = findOneAndReplace[T](ctx, ms, collection, filter, filterB, doc, fm, versioned)
+	}
+	if errR != nil && version != nil {
+		version.Version--
+	}
+	return result, errR
+}
+
+// findOneAndReplace esegue FindOneAndReplace con il filtro e il sostituto già preparati.
+func findOneAndReplace[T ICollection](ctx context.Context, ms *mongolks.LinkedService, collection string, filter IFilter, filterB bson.M, replacement any, fm FindAndModifyOptions, versioned bool) (*T, *core.ApplicationError) {
+	opts := options.FindOneAndReplace().SetUpsert(fm.Upsert).SetCollation(filterCollation(filter))
+	if fm.ReturnAfter {
+		opts.SetReturnDocument(options.After)
+	}
+	if len(fm.Sort) > 0 {
+		opts.SetSort(SortToBson(fm.Sort))
+	}
+	if p := fm.projection(viewProjection[T]()); p != nil {
+		opts.SetProjection(p.bson())
+	}
+	var obj T
+	err := ms.GetCollection(collection, "").FindOneAndReplace(ctx, filterB, replacement, opts).Decode(&obj)
+	return findAndModifyResult(ctx, &obj, err, fm, collection, versioned)
+}
+
+// findAndModifyReplace restituisce filtro e sostituto di FindOneAndReplace: per un documento Auditable
+// il sostituto è la pipeline di update di auditReplacement, da eseguire con FindOneAndUpdate. Per un
+// documento Versioned restituisce anche la versione, già incrementata e da ripristinare se la scrittura fallisce.
+func findAndModifyReplace(ctx context.Context, collection string, policy *documentPolicy, filter IFilter, replacement ICollection) (bson.M, any, *VersionFields, *core.ApplicationError) {
+	if errH := beforeReplace(ctx, replacement); errH != nil {
+		return nil, nil, nil, errH
+	}
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, nil, nil, core.TechnicalErrorWithError(errB)
+	}
+	filterB = excludeDeleted(collection, filter, filterB)
+	var version *VersionFields
+	if v, ok := versionedOf(replacement); ok {
+		replacement = v
+		version = v.Versioning()
+		filterB = withVersion(filterB, version.Version)
+		version.Version++
+	}
+	if !policy.auditable {
+		return filterB, replacement, version, nil
+	}
+	pipeline, errA := auditReplacement(replacement, newAuditStamp(ctx))
+	if errA != nil {
+		if version != nil {
+			version.Version--
+		}
+		return nil, nil, nil, core.TechnicalErrorWithError(errA)
+	}
+	return filterB, pipeline, version, nil
+}
+
+// FindOneAndDelete rimuove in modo atomico il documento che soddisfa il filtro e lo restituisce.
+// Se nessun documento soddisfa il filtro restituisce NotFoundError (MON-CONFLICT con AtVersion). Sulle collection con
+// cancellazione logica il documento viene marcato come cancellato e restituito com'era prima. IBeforeDelete
+// viene chiamato come in DeleteOne.
+func FindOneAndDelete[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	if errR := checkFindAndModify[T](ctx); errR != nil {
+		return nil, errR
+	}
+	if errH := beforeDelete(ctx, policyOf[T](), filter); errH != nil {
+		return nil, errH
+	}
+	collection := collectionOf[T](ctx)
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	if policyOf[T]().softDelete {
+		return findOneAndUpdate[T](ctx, ms, collection, filter, notDeleted(filterB), softDeleteUpdate(ctx), FindAndModifyOptions{Sort: fm.Sort, Projection: fm.Projection}, hasVersion(filter))
+	}
+
+	opts := options.FindOneAndDelete().SetCollation(filterCollation(filter))
+	if len(fm.Sort) > 0 {
+		opts.SetSort(SortToBson(fm.Sort))
+	}
+	if p := fm.projection(viewProjection[T]()); p != nil {
+		opts.SetProjection(p.bson())
+	}
+	var obj T
+	err := ms.GetCollection(collection, "").FindOneAndDelete(ctx, filterB, opts).Decode(&obj)
+	return findAndModifyResult(ctx, &obj, err, FindAndModifyOptions{}, collection, hasVersion(filter))
+}
+
+// findAndModifyResult restituisce il documento letto o l'errore. Con versioned il filtro richiede una
+// versione: un documento non trovato, o un upsert che tenta di inserirlo di nuovo, è un conflitto.
+func findAndModifyResult[T any](ctx context.Context, obj *T, err error, fm FindAndModifyOptions, collection string, versioned bool) (*T, *core.ApplicationError) {
+	if err == nil {
+		if errH := afterFind(ctx, obj); errH != nil {
+			return nil, errH
+		}
+		return obj, nil
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if fm.Upsert && !fm.ReturnAfter {
+			// Il documento è stato inserito: non esisteva un documento precedente
+			return nil, nil
+		}
+		if versioned {
+			return nil, versionConflictError(collection)
+		}
+		return nil, core.NotFoundError()
+	}
+	if versioned && isVersionConflictWrite(err) {
+		return nil, versionConflictError(collection)
+	}
+	log.Error().Err(err).Msgf("Impossibile modificare %s", collection)
+	return nil, core.TechnicalErrorWithError(err)
+}
@@ -0,0 +1,132 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestFindAndModifyResult(t *testing.T) {
+	doc := &testBulkDoc{ID: "1"}
+	if got, err := findAndModifyResult(context.Background(), doc, nil, FindAndModifyOptions{}, "test", false); err != nil || got != doc {
+		t.Errorf("atteso il documento, ottenuto %v, %v", got, err)
+	}
+
+	_, err := findAndModifyResult(context.Background(), doc, mongo.ErrNoDocuments, FindAndModifyOptions{}, "test", false)
+	if err == nil || err.Code != core.NotFoundError().Code {
+		t.Errorf("atteso NotFoundError, ottenuto %v", err)
+	}
+	_, err = findAndModifyResult(context.Background(), doc, mongo.ErrNoDocuments, FindAndModifyOptions{Upsert: true, ReturnAfter: true}, "test", false)
+	if err == nil || err.Code != core.NotFoundError().Code {
+		t.Errorf("atteso NotFoundError con upsert e documento successivo, ottenuto %v", err)
+	}
+	if got, err := findAndModifyResult(context.Background(), doc, mongo.ErrNoDocuments, FindAndModifyOptions{Upsert: true}, "test", false); err != nil || got != nil {
+		t.Errorf("un upsert senza documento precedente non è un errore, ottenuto %v, %v", got, err)
+	}
+
+	_, err = findAndModifyResult(context.Background(), doc, errors.New("boom"), FindAndModifyOptions{}, "test", false)
+	if err == nil || err.Code == core.NotFoundError().Code {
+		t.Errorf("atteso errore tecnico, ottenuto %v", err)
+	}
+
+	_, err = findAndModifyResult(context.Background(), doc, mongo.ErrNoDocuments, FindAndModifyOptions{}, "test", true)
+	if !IsVersionConflict(err) {
+		t.Errorf("atteso MON-CONFLICT per un documento non trovato alla versione, ottenuto %v", err)
+	}
+	if got, err := findAndModifyResult(context.Background(), doc, mongo.ErrNoDocuments, FindAndModifyOptions{Upsert: true}, "test", true); err != nil || got != nil {
+		t.Errorf("un upsert alla versione senza documento precedente non è un errore, ottenuto %v, %v", got, err)
+	}
+
+	if p := (FindAndModifyOptions{}).projection(Include("a")); len(p) != 1 {
+		t.Errorf("attesa la proiezione della vista, ottenuto %v", p)
+	}
+	if p := (FindAndModifyOptions{Projection: Exclude("b")}).projection(Include("a")); p[0].Key != "b" {
+		t.Errorf("attesa la proiezione esplicita, ottenuto %v", p)
+	}
+}
+
+func TestFindAndModifyAudit(t *testing.T) {
+	withTestPrincipal(t, "mario")
+	ctx := context.Background()
+	filter := NewQuery("test_audit", Where("_id").Eq("1"))
+
+	_, update, err := findAndModifyUpdate(ctx, "test_audit", policyOf[testAuditDoc](), filter, NewUpdate().Set("name", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := lookupD(update.(bson.D), "$set")
+	if by, _ := lookupD(set.(bson.D), UpdatedByField); by != "mario" {
+		t.Errorf("updatedBy non valorizzato: %v", update)
+	}
+
+	obj := &testAuditDoc{ID: "1", Name: "x", AuditFields: AuditFields{CreatedBy: "altro"}}
+	_, replacement, _, err := findAndModifyReplace(ctx, "test_audit", policyOf[testAuditDoc](), filter, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replacement.(mongo.Pipeline); !ok || obj.UpdatedBy != "mario" {
+		t.Errorf("replace di un documento Auditable senza la pipeline di audit: %T %+v", replacement, obj.AuditFields)
+	}
+	if _, replacement, _, _ = findAndModifyReplace(ctx, "test", policyOf[testBulkDoc](), filter, testBulkDoc{ID: "1"}); replacement != (testBulkDoc{ID: "1"}) {
+		t.Errorf("sostituto modificato per un documento senza audit: %v", replacement)
+	}
+}
+
+func TestFindAndModifyVersion(t *testing.T) {
+	ctx := context.Background()
+	filter := NewQuery("test_version", Where("_id").Eq("1"))
+
+	_, update, err := findAndModifyUpdate(ctx, "test_version", policyOf[testVersionDoc](), filter, NewUpdate().Set("name", "x").Set(VersionField, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, bson.M{"update": update}, `{"update": {"$set": {"name": "x"}, "$inc": {"version": 1}}}`)
+
+	obj := &testVersionDoc{ID: "1", VersionFields: VersionFields{Version: 3}}
+	filterB, replacement, version, err := findAndModifyReplace(ctx, "test_version", policyOf[testVersionDoc](), filter, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version == nil || obj.Version != 4 || replacement != obj {
+		t.Errorf("attesa la versione incrementata sul documento, ottenuto %+v %v", obj, replacement)
+	}
+	assertFilterJSON(t, filterB, `{"_id": {"$eq": "1"}, "version": 3}`)
+
+	_, _, version, _ = findAndModifyReplace(ctx, "test", policyOf[testBulkDoc](), filter, &testBulkDoc{ID: "1"})
+	if version != nil {
+		t.Errorf("versione restituita per un documento senza versione: %+v", version)
+	}
+}
+
+func TestFindAndModifyHistory(t *testing.T) {
+	ctx := context.Background()
+	RegisterDocument[testHistoryDoc](ctx)
+	filter := NewQuery("test_history", Where("_id").Eq("1"))
+
+	if _, err := FindOneAndUpdate[testHistoryDoc](ctx, nil, filter, NewUpdate().Set("a", 1), FindAndModifyOptions{}); err == nil || err.Code != "MON-HISTORY" {
+		t.Errorf("atteso MON-HISTORY da FindOneAndUpdate, ottenuto %v", err)
+	}
+	if _, err := FindOneAndReplace(ctx, nil, filter, testHistoryDoc{ID: "1"}, FindAndModifyOptions{}); err == nil || err.Code != "MON-HISTORY" {
+		t.Errorf("atteso MON-HISTORY da FindOneAndReplace, ottenuto %v", err)
+	}
+	if _, err := FindOneAndDelete[testHistoryDoc](ctx, nil, filter, FindAndModifyOptions{}); err == nil || err.Code != "MON-HISTORY" {
+		t.Errorf("atteso MON-HISTORY da FindOneAndDelete, ottenuto %v", err)
+	}
+}
+
+func TestFindAndModifyHooks(t *testing.T) {
+	ctx := context.Background()
+	RegisterDocument[testHookDoc](ctx)
+
+	_, err := FindOneAndUpdate[testHookDoc](ctx, nil, NewQuery("test_hooks", Where("_id").Eq("1")), NewUpdate().Set("fiscale", "X"), FindAndModifyOptions{})
+	if err == nil || err.Code != "HOOK-IMMUTABILE" {
+		t.Errorf("atteso l'errore di BeforeUpdate, ottenuto %v", err)
+	}
+	if _, err = FindOneAndDelete[testHookDoc](ctx, nil, NewQuery("test_hooks"), FindAndModifyOptions{}); err == nil || err.Code != "MON-HOOK" {
+		t.Errorf("atteso l'errore di BeforeDelete, ottenuto %v", err)
+	}
+}
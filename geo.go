@@ -0,0 +1,218 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// EarthRadiusKm è il raggio terrestre usato per convertire le distanze in radianti ($centerSphere).
+const EarthRadiusKm = 6378.1
+
+// nearOperators sono gli operatori che ordinano per distanza, non ammessi dal conteggio dei documenti.
+var nearOperators = []string{"$near", "$nearSphere"}
+
+// GeoPoint è un punto GeoJSON. Le coordinate sono nell'ordine [longitudine, latitudine].
+type GeoPoint struct {
+	Type        string     `bson:"type" json:"type"`
+	Coordinates [2]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// NewGeoPoint restituisce il punto GeoJSON di longitudine e latitudine indicate.
+func NewGeoPoint(lng, lat float64) GeoPoint {
+	return GeoPoint{Type: "Point", Coordinates: [2]float64{lng, lat}}
+}
+
+// GeoPolygon è un poligono GeoJSON: il primo anello è il perimetro esterno, gli altri sono i buchi.
+// Ogni anello deve essere chiuso (primo e ultimo punto coincidenti).
+type GeoPolygon struct {
+	Type        string         `bson:"type" json:"type"`
+	Coordinates [][][2]float64 `bson:"coordinates" json:"coordinates"`
+}
+
+// NewGeoPolygon restituisce il poligono GeoJSON con gli anelli indicati.
+func NewGeoPolygon(rings ...[][2]float64) GeoPolygon {
+	return GeoPolygon{Type: "Polygon", Coordinates: rings}
+}
+
+// GeoNear è il valore dell'operatore $near: le distanze sono in metri, uno zero non viene applicato.
+type GeoNear struct {
+	Point       GeoPoint `json:"point"`
+	MinDistance float64  `json:"minDistance,omitempty"`
+	MaxDistance float64  `json:"maxDistance,omitempty"`
+}
+
+// GeoBox è un rettangolo in coordinate legacy per $geoWithin.
+type GeoBox struct {
+	BottomLeft [2]float64 `json:"bottomLeft"`
+	UpperRight [2]float64 `json:"upperRight"`
+}
+
+// GeoCenterSphere è un cerchio sferico per $geoWithin, con raggio in radianti.
+type GeoCenterSphere struct {
+	Center [2]float64 `json:"center"`
+	Radius float64    `json:"radius"`
+}
+
+// NewGeoCenterSphereKm restituisce il cerchio sferico con centro e raggio in chilometri.
+func NewGeoCenterSphereKm(lng, lat, radiusKm float64) GeoCenterSphere {
+	return GeoCenterSphere{Center: [2]float64{lng, lat}, Radius: radiusKm / EarthRadiusKm}
+}
+
+func handleNearOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	var near GeoNear
+	switch v := fieldValue.(type) {
+	case GeoNear:
+		near = v
+	case GeoPoint:
+		near = GeoNear{Point: v}
+	default:
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo GeoNear o GeoPoint", operator)
+	}
+	if near.Point.Type == "" {
+		return bson.M{}, nil
+	}
+	condition := bson.M{"$geometry": near.Point}
+	if near.MinDistance > 0 {
+		condition["$minDistance"] = near.MinDistance
+	}
+	if near.MaxDistance > 0 {
+		condition["$maxDistance"] = near.MaxDistance
+	}
+	return bson.M{operator: condition}, nil
+}
+
+func handleGeoWithinOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	switch v := fieldValue.(type) {
+	case GeoPolygon:
+		if v.Type == "" {
+			return bson.M{}, nil
+		}
+		return bson.M{operator: bson.M{"$geometry": v}}, nil
+	case GeoBox:
+		if v == (GeoBox{}) {
+			return bson.M{}, nil
+		}
+		return bson.M{operator: bson.M{"$box": bson.A{v.BottomLeft, v.UpperRight}}}, nil
+	case GeoCenterSphere:
+		if v.Radius == 0 {
+			return bson.M{}, nil
+		}
+		return bson.M{operator: bson.M{"$centerSphere": bson.A{v.Center, v.Radius}}}, nil
+	default:
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo GeoPolygon, GeoBox o GeoCenterSphere", operator)
+	}
+}
+
+func handleGeoIntersectsOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	switch v := fieldValue.(type) {
+	case GeoPoint:
+		if v.Type == "" {
+			return bson.M{}, nil
+		}
+		return bson.M{operator: bson.M{"$geometry": v}}, nil
+	case GeoPolygon:
+		if v.Type == "" {
+			return bson.M{}, nil
+		}
+		return bson.M{operator: bson.M{"$geometry": v}}, nil
+	default:
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo GeoPoint o GeoPolygon", operator)
+	}
+}
+
+// countFilter restituisce il filtro da usare per il conteggio dei documenti. Il server non ammette
+// $near e $nearSphere in countDocuments: vengono sostituiti da un $geoWithin con $centerSphere che
+// seleziona gli stessi documenti, senza l'ordinamento per distanza. Senza $maxDistance resta la sola
+// esistenza del campo. Sono supportate solo le condizioni con un GeoPoint in $geometry.
+func countFilter(filter bson.M) (bson.M, error) {
+	out := make(bson.M, len(filter))
+	conditions := bson.A{}
+	for key, value := range filter {
+		if members, ok := value.(bson.A); ok && logicalOperators[key] {
+			rewritten := make(bson.A, 0, len(members))
+			for _, member := range members {
+				if m, ok := member.(bson.M); ok {
+					r, err := countFilter(m)
+					if err != nil {
+						return nil, err
+					}
+					member = r
+				}
+				rewritten = append(rewritten, member)
+			}
+			out[key] = rewritten
+			continue
+		}
+		ops, ok := value.(bson.M)
+		if !ok || strings.HasPrefix(key, "$") {
+			out[key] = value
+			continue
+		}
+		remaining := bson.M{}
+		for op, arg := range ops {
+			if !slices.Contains(nearOperators, op) {
+				remaining[op] = arg
+				continue
+			}
+			near, err := nearCountConditions(key, op, arg)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, near...)
+		}
+		if len(remaining) > 0 {
+			out[key] = remaining
+		}
+	}
+	if len(conditions) > 0 {
+		previous, _ := out["$and"].(bson.A)
+		out["$and"] = append(previous, conditions...)
+	}
+	return out, nil
+}
+
+// nearCountConditions restituisce le condizioni equivalenti a $near/$nearSphere sul campo path.
+func nearCountConditions(path, operator string, arg any) (bson.A, error) {
+	spec, _ := arg.(bson.M)
+	point, ok := spec["$geometry"].(GeoPoint)
+	if !ok {
+		return nil, fmt.Errorf("conteggio con '%s' sul campo '%s' supportato solo con un GeoPoint in $geometry", operator, path)
+	}
+	within := func(meters float64) bson.M {
+		return bson.M{path: bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{point.Coordinates, meters / (EarthRadiusKm * 1000)}}}}
+	}
+	conditions := bson.A{bson.M{path: bson.M{"$exists": true}}}
+	if maxDistance, ok := spec["$maxDistance"].(float64); ok && maxDistance > 0 {
+		conditions = bson.A{within(maxDistance)}
+	}
+	if minDistance, ok := spec["$minDistance"].(float64); ok && minDistance > 0 {
+		conditions = append(conditions, bson.M{"$nor": bson.A{within(minDistance)}})
+	}
+	return conditions, nil
+}
+
+// CreateGeoIndex crea un indice 2dsphere sui campi indicati della collection del documento
+// e restituisce il nome dell'indice. Se l'indice esiste già l'operazione non ha effetto.
+func CreateGeoIndex(ctx context.Context, ms *mongolks.LinkedService, obj ICollection, fields ...string) (string, *core.ApplicationError) {
+	if len(fields) == 0 {
+		return "", core.TechnicalErrorWithCodeAndMessage("MON-GEOIDX", "nessun campo per l'indice 2dsphere")
+	}
+	keys := bson.D{}
+	for _, f := range fields {
+		keys = append(keys, bson.E{Key: f, Value: "2dsphere"})
+	}
+	name, err := ms.GetCollection(obj.GetCollectionName(ctx), "").Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+	if err != nil {
+		log.Error().Err(err).Msgf("Impossibile creare l'indice 2dsphere su %s", obj.GetCollectionName(ctx))
+		return "", core.TechnicalErrorWithError(err)
+	}
+	return name, nil
+}
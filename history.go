@@ -0,0 +1,320 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// HistorySuffix è il suffisso della collection dello storico: lo storico di "contratti" è "contratti_history".
+const HistorySuffix = "_history"
+
+// Operazioni registrate nello storico.
+const (
+	HistoryCreate     = "create"
+	HistoryUpdate     = "update"
+	HistoryReplace    = "replace"
+	HistoryDelete     = "delete"
+	HistorySoftDelete = "softDelete"
+)
+
+// IHistory è implementato dai documenti di cui conservare lo storico: ogni insert, update, replace e
+// delete eseguito con le funzioni di collection.go scrive nella collection <collection>_history un
+// HistoryEntry per documento modificato, con utente, data, operazione e differenze campo per campo. Un
+// documento inserito, anche da un upsert, viene registrato come create. Le scritture usano il contesto
+// ricevuto: dentro ExecTransaction lo storico viene scritto nella stessa transazione, che rende anche
+// atomica la lettura dello stato precedente con la scrittura. Il documento viene riconosciuto dal tipo.
+// BulkInsert registra lo storico e UpsertMany scrive i documenti uno alla volta con Upsert; le altre
+// operazioni di BulkWrite, FindOneAndUpdate, FindOneAndReplace e FindOneAndDelete restituiscono MON-HISTORY.
+//
+//	func (Contratto) History() {}
+type IHistory interface {
+	ICollection
+	History()
+}
+
+// HistoryEntry è la modifica di un documento registrata nello storico.
+type HistoryEntry struct {
+	ID         bson.ObjectID `bson:"_id,omitempty" json:"id"`
+	DocumentID any           `bson:"documentId" json:"documentId"`
+	Operation  string        `bson:"operation" json:"operation"`
+	Actor      string        `bson:"actor" json:"actor"`
+	Timestamp  time.Time     `bson:"timestamp" json:"timestamp"`
+	Changes    []FieldChange `bson:"changes" json:"changes"`
+}
+
+// FieldChange è la modifica di un campo: i documenti annidati sono confrontati campo per campo
+// (es. "indirizzo.citta"), gli array come valore unico.
+type FieldChange struct {
+	Field  string `bson:"field" json:"field"`
+	Before any    `bson:"before,omitempty" json:"before,omitempty"`
+	After  any    `bson:"after,omitempty" json:"after,omitempty"`
+	// Added indica un campo assente prima della modifica, Removed uno assente dopo.
+	Added   bool `bson:"added,omitempty" json:"added,omitempty"`
+	Removed bool `bson:"removed,omitempty" json:"removed,omitempty"`
+}
+
+// historyWrite esegue la scrittura con il filtro indicato e restituisce l'eventuale _id inserito da un upsert.
+type historyWrite func(filterB bson.M) (any, error)
+
+// writeWithHistory esegue la scrittura e, se history è true, registra le modifiche dei documenti: legge
+// i documenti che soddisfano il filtro (uno solo se many è false), limita la scrittura a quei documenti
+// e li rilegge dopo la scrittura. Il documento inserito da un upsert viene registrato come create.
+func writeWithHistory(ctx context.Context, coll *mongo.Collection, history bool, operation string, filterB bson.M, collation *options.Collation, many bool, write historyWrite) error {
+	if !history {
+		_, err := write(filterB)
+		return err
+	}
+
+	fo := options.Find().SetCollation(collation)
+	if !many {
+		fo.SetLimit(1)
+	}
+	befores, err := findRawDocuments(ctx, coll, filterB, fo)
+	if err != nil {
+		return err
+	}
+	ids := make(bson.A, 0, len(befores))
+	for _, doc := range befores {
+		ids = append(ids, doc.Lookup("_id"))
+	}
+	if len(ids) > 0 {
+		filterB = bson.M{"$and": bson.A{filterB, bson.M{"_id": bson.M{"$in": ids}}}}
+	}
+	upsertedID, err := write(filterB)
+	if err != nil {
+		return err
+	}
+	if upsertedID != nil {
+		ids = append(ids, rawValueOf(upsertedID))
+		befores = append(befores, nil)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	afters := map[string]bson.Raw{}
+	if operation != HistoryDelete || upsertedID != nil {
+		if afters, err = findRawDocumentsByID(ctx, coll, ids); err != nil {
+			return err
+		}
+	}
+	return writeHistory(ctx, coll, operation, ids, befores, afters)
+}
+
+// insertHistory registra nello storico i documenti inseriti con gli _id indicati.
+func insertHistory(ctx context.Context, coll *mongo.Collection, insertedIDs []any) error {
+	if len(insertedIDs) == 0 {
+		return nil
+	}
+	ids := make(bson.A, 0, len(insertedIDs))
+	for _, id := range insertedIDs {
+		ids = append(ids, rawValueOf(id))
+	}
+	afters, err := findRawDocumentsByID(ctx, coll, ids)
+	if err != nil {
+		return err
+	}
+	return writeHistory(ctx, coll, HistoryCreate, ids, make([]bson.Raw, len(ids)), afters)
+}
+
+// writeHistory scrive le voci di storico dei documenti con gli _id indicati, dallo stato precedente
+// (nil per un documento inserito, registrato come create) a quello successivo.
+func writeHistory(ctx context.Context, coll *mongo.Collection, operation string, ids bson.A, befores []bson.Raw, afters map[string]bson.Raw) error {
+	s := newAuditStamp(ctx)
+	entries := make([]any, 0, len(ids))
+	for i, id := range ids {
+		changes := diffDocuments("", befores[i], afters[id.(bson.RawValue).String()])
+		if len(changes) == 0 {
+			continue
+		}
+		op := operation
+		if befores[i] == nil {
+			op = HistoryCreate
+		}
+		entries = append(entries, HistoryEntry{DocumentID: id, Operation: op, Actor: s.by, Timestamp: s.at, Changes: changes})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if _, err := coll.Database().Collection(coll.Name()+HistorySuffix).InsertMany(ctx, entries); err != nil {
+		log.Error().Err(err).Msgf("Impossibile scrivere lo storico di %s", coll.Name())
+		return err
+	}
+	return nil
+}
+
+// findRawDocumentsByID restituisce i documenti con gli _id indicati, per _id.
+func findRawDocumentsByID(ctx context.Context, coll *mongo.Collection, ids bson.A) (map[string]bson.Raw, error) {
+	docs, err := findRawDocuments(ctx, coll, bson.M{"_id": bson.M{"$in": ids}}, options.Find())
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]bson.Raw, len(docs))
+	for _, doc := range docs {
+		byID[doc.Lookup("_id").String()] = doc
+	}
+	return byID, nil
+}
+
+func findRawDocuments(ctx context.Context, coll *mongo.Collection, filterB bson.M, fo options.Lister[options.FindOptions]) ([]bson.Raw, error) {
+	cur, err := coll.Find(ctx, filterB, fo)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]bson.Raw, 0)
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// diffDocuments restituisce le modifiche dei campi tra i due documenti (nil se assente).
+func diffDocuments(prefix string, before, after bson.Raw) []FieldChange {
+	changes := make([]FieldChange, 0)
+	beforeElems, _ := before.Elements()
+	for _, el := range beforeElems {
+		field := prefix + el.Key()
+		bv := el.Value()
+		av, err := after.LookupErr(el.Key())
+		switch {
+		case err != nil:
+			changes = append(changes, FieldChange{Field: field, Before: rawToAny(bv), Removed: true})
+		case bv.Type == bson.TypeEmbeddedDocument && av.Type == bson.TypeEmbeddedDocument:
+			changes = append(changes, diffDocuments(field+".", bv.Document(), av.Document())...)
+		case !bv.Equal(av):
+			changes = append(changes, FieldChange{Field: field, Before: rawToAny(bv), After: rawToAny(av)})
+		}
+	}
+	afterElems, _ := after.Elements()
+	for _, el := range afterElems {
+		if _, err := before.LookupErr(el.Key()); err != nil {
+			changes = append(changes, FieldChange{Field: prefix + el.Key(), After: rawToAny(el.Value()), Added: true})
+		}
+	}
+	return changes
+}
+
+func rawToAny(v bson.RawValue) any {
+	var out any
+	if err := v.Unmarshal(&out); err != nil {
+		return v
+	}
+	return out
+}
+
+// GetHistory restituisce lo storico del documento con l'_id indicato, dalla modifica più vecchia.
+func GetHistory(ctx context.Context, ms *mongolks.LinkedService, collection string, id any) ([]HistoryEntry, *core.ApplicationError) {
+	cur, err := ms.GetCollection(collection+HistorySuffix, "").Find(ctx, bson.M{"documentId": id},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	entries := make([]HistoryEntry, 0)
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	return entries, nil
+}
+
+// GetObjectAsOf ricostruisce il documento con l'_id indicato com'era al momento at, annullando
+// sullo stato attuale le modifiche registrate nello storico dopo at. Un documento cancellato viene
+// ricostruito dallo storico della cancellazione, uno inserito dopo at viene annullato dalla sua voce
+// create. Restituisce NotFoundError se il documento non esisteva al momento indicato o se non è
+// possibile ricostruirlo; un documento inserito prima di attivare lo storico viene ricostruito fino
+// alla prima modifica registrata.
+//
+//	contratto, err := coremongo.GetObjectAsOf[Contratto](ctx, ms, id, time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC))
+func GetObjectAsOf[T ICollection](ctx context.Context, ms *mongolks.LinkedService, id any, at time.Time) (*T, *core.ApplicationError) {
+	var obj T
+	collection := obj.GetCollectionName(ctx)
+
+	var current bson.D
+	err := ms.GetCollection(collection, "").FindOne(ctx, bson.M{"_id": id}).Decode(&current)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	cur, err := ms.GetCollection(collection+HistorySuffix, "").Find(ctx, bson.M{"documentId": id, "timestamp": bson.M{"$gt": at}},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}))
+	if err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	entries := make([]HistoryEntry, 0)
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	current = revertChanges(current, entries)
+	if len(current) == 0 {
+		return nil, core.NotFoundError()
+	}
+
+	raw, errM := bson.Marshal(current)
+	if errM != nil {
+		return nil, core.TechnicalErrorWithError(errM)
+	}
+	if err := bson.Unmarshal(raw, &obj); err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	return &obj, nil
+}
+
+// revertChanges annulla sul documento le modifiche delle voci di storico, ordinate dalla più recente.
+func revertChanges(doc bson.D, entries []HistoryEntry) bson.D {
+	for _, entry := range entries {
+		for _, c := range entry.Changes {
+			if c.Added {
+				doc = unsetPath(doc, c.Field)
+			} else {
+				doc = setPath(doc, c.Field, c.Before)
+			}
+		}
+	}
+	return doc
+}
+
+// setPath imposta il campo indicato con notazione puntata, creando i documenti intermedi.
+func setPath(doc bson.D, path string, value any) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			doc[i].Value = value
+		} else {
+			sub, _ := e.Value.(bson.D)
+			doc[i].Value = setPath(sub, rest, value)
+		}
+		return doc
+	}
+	if !nested {
+		return append(doc, bson.E{Key: key, Value: value})
+	}
+	return append(doc, bson.E{Key: key, Value: setPath(nil, rest, value)})
+}
+
+// unsetPath rimuove il campo indicato con notazione puntata.
+func unsetPath(doc bson.D, path string) bson.D {
+	key, rest, nested := strings.Cut(path, ".")
+	for i, e := range doc {
+		if e.Key != key {
+			continue
+		}
+		if !nested {
+			return append(doc[:i], doc[i+1:]...)
+		}
+		if sub, ok := e.Value.(bson.D); ok {
+			doc[i].Value = unsetPath(sub, rest)
+		}
+		return doc
+	}
+	return doc
+}
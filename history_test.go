@@ -0,0 +1,121 @@
+package coremongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testHistoryDoc struct {
+	ID string `bson:"_id" upsertKey:"true"`
+}
+
+func (testHistoryDoc) GetCollectionName(ctx context.Context) string { return "test_history" }
+func (*testHistoryDoc) History()                                    {}
+
+func mustRaw(t *testing.T, doc any) bson.Raw {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestDiffDocuments(t *testing.T) {
+	before := mustRaw(t, bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "stato", Value: "BOZZA"},
+		{Key: "note", Value: "x"},
+		{Key: "indirizzo", Value: bson.D{{Key: "citta", Value: "Roma"}, {Key: "cap", Value: "00100"}}},
+	})
+	after := mustRaw(t, bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "stato", Value: "FIRMATO"},
+		{Key: "indirizzo", Value: bson.D{{Key: "citta", Value: "Milano"}, {Key: "cap", Value: "00100"}}},
+		{Key: "firmatoDa", Value: "mario"},
+	})
+
+	got := diffDocuments("", before, after)
+	want := []FieldChange{
+		{Field: "stato", Before: "BOZZA", After: "FIRMATO"},
+		{Field: "note", Before: "x", Removed: true},
+		{Field: "indirizzo.citta", Before: "Roma", After: "Milano"},
+		{Field: "firmatoDa", After: "mario", Added: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("differenze errate:\n got  %+v\n want %+v", got, want)
+	}
+
+	if changes := diffDocuments("", before, before); len(changes) != 0 {
+		t.Errorf("differenze su documenti uguali: %+v", changes)
+	}
+	if changes := diffDocuments("", before, nil); len(changes) != 4 {
+		t.Errorf("la cancellazione deve rimuovere tutti i campi: %+v", changes)
+	}
+}
+
+func TestRevertChanges(t *testing.T) {
+	before := bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "stato", Value: "BOZZA"},
+		{Key: "note", Value: "x"},
+		{Key: "indirizzo", Value: bson.D{{Key: "citta", Value: "Roma"}}},
+	}
+	after := bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "stato", Value: "FIRMATO"},
+		{Key: "indirizzo", Value: bson.D{{Key: "citta", Value: "Milano"}}},
+		{Key: "firmatoDa", Value: "mario"},
+	}
+	entries := []HistoryEntry{{Changes: diffDocuments("", mustRaw(t, before), mustRaw(t, after))}}
+
+	got := revertChanges(after, entries)
+	if FilterToJson(bson.M{"d": got}) != FilterToJson(bson.M{"d": bson.D{
+		{Key: "_id", Value: "1"},
+		{Key: "stato", Value: "BOZZA"},
+		{Key: "indirizzo", Value: bson.D{{Key: "citta", Value: "Roma"}}},
+		{Key: "note", Value: "x"},
+	}}) {
+		t.Errorf("ricostruzione errata: %v", got)
+	}
+
+	deleted := []HistoryEntry{{Operation: HistoryDelete, Changes: diffDocuments("", mustRaw(t, before), nil)}}
+	if got := revertChanges(nil, deleted); len(got) != len(before) {
+		t.Errorf("documento cancellato non ricostruito: %v", got)
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	doc := setPath(nil, "a.b", 1)
+	doc = setPath(doc, "a.c", 2)
+	doc = unsetPath(doc, "a.b")
+	doc = unsetPath(doc, "x.y")
+	if FilterToJson(bson.M{"d": doc}) != FilterToJson(bson.M{"d": bson.D{{Key: "a", Value: bson.D{{Key: "c", Value: 2}}}}}) {
+		t.Errorf("percorso puntato errato: %v", doc)
+	}
+}
+
+func TestRevertSoftDeleteAndCreate(t *testing.T) {
+	doc := bson.D{{Key: "_id", Value: "1"}, {Key: "stato", Value: "BOZZA"}}
+	deleted := append(bson.D{}, doc...)
+	deleted = append(deleted, bson.E{Key: DeletedAtField, Value: "2025-01-01"}, bson.E{Key: DeletedByField, Value: "mario"})
+	softDeleted := []HistoryEntry{{Operation: HistorySoftDelete, Changes: diffDocuments("", mustRaw(t, doc), mustRaw(t, deleted))}}
+	if got := revertChanges(deleted, softDeleted); FilterToJson(bson.M{"d": got}) != FilterToJson(bson.M{"d": doc}) {
+		t.Errorf("cancellazione logica non annullata: %v", got)
+	}
+
+	updated := bson.D{{Key: "_id", Value: "1"}, {Key: "stato", Value: "FIRMATO"}}
+	entries := []HistoryEntry{
+		{Operation: HistoryUpdate, Changes: diffDocuments("", mustRaw(t, doc), mustRaw(t, updated))},
+		{Operation: HistoryCreate, Changes: diffDocuments("", nil, mustRaw(t, doc))},
+	}
+	if got := revertChanges(append(bson.D{}, updated...), entries[:1]); FilterToJson(bson.M{"d": got}) != FilterToJson(bson.M{"d": doc}) {
+		t.Errorf("documento inserito non ricostruito: %v", got)
+	}
+	if got := revertChanges(append(bson.D{}, updated...), entries); len(got) != 0 {
+		t.Errorf("documento presente prima dell'inserimento: %v", got)
+	}
+}
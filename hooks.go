@@ -0,0 +1,180 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// IBeforeInsert è implementato dai documenti da preparare o validare prima dell'inserimento
+// (InsertOne, InsertMany, BulkInsert). Il documento va passato per puntatore per applicare le modifiche.
+// Upsert e UpsertMany non sanno se il documento verrà inserito e non lo chiamano, come IBeforeReplace:
+// chiamano IBeforeUpdate con l'update dell'upsert.
+type IBeforeInsert interface {
+	BeforeInsert(ctx context.Context) error
+}
+
+// IBeforeReplace è implementato dai documenti da preparare o validare prima di ReplaceOne,
+// FindOneAndReplace, BulkReplace e BulkUpsert.
+type IBeforeReplace interface {
+	BeforeReplace(ctx context.Context) error
+}
+
+// IAfterFind è implementato dai documenti che calcolano campi derivati dopo la lettura: viene
+// chiamato su ogni documento restituito dalle funzioni di lettura (GetObjectById, GetObjectsByFilter,
+// GetPageByFilter, keyset, streaming, find and modify, ...).
+type IAfterFind interface {
+	AfterFind(ctx context.Context) error
+}
+
+// IBeforeUpdate è implementato dai documenti che controllano gli update prima di UpdateOne,
+// UpdateMany, FindOneAndUpdate e delle bulk update, ad esempio per rifiutare la modifica di campi immutabili (vedi
+// UpdatedFields). Viene chiamato su un nuovo valore zero del documento registrato per la collection
+// (vedi RegisterDocument), quindi non deve dipendere dallo stato del ricevitore.
+type IBeforeUpdate interface {
+	BeforeUpdate(ctx context.Context, update any) error
+}
+
+// IBeforeDelete è implementato dai documenti che controllano le cancellazioni prima di DeleteOne,
+// DeleteMany, FindOneAndDelete e delle bulk delete; riceve il filtro della cancellazione. Come IBeforeUpdate viene
+// chiamato sul valore zero del documento.
+type IBeforeDelete interface {
+	BeforeDelete(ctx context.Context, filter bson.M) error
+}
+
+// hookError restituisce l'errore dell'hook come ApplicationError: un ApplicationError viene
+// restituito così com'è, gli altri errori come errore di business MON-HOOK.
+func hookError(hook string, err error) *core.ApplicationError {
+	var appErr *core.ApplicationError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	log.Warn().Err(err).Msgf("operazione interrotta da %s", hook)
+	return core.BusinessErrorWithCodeAndMessage("MON-HOOK", err.Error())
+}
+
+func beforeInsert(ctx context.Context, obj any) *core.ApplicationError {
+	if h, ok := obj.(IBeforeInsert); ok && !isNilPointer(obj) {
+		if err := h.BeforeInsert(ctx); err != nil {
+			return hookError("BeforeInsert", err)
+		}
+	}
+	return nil
+}
+
+func beforeReplace(ctx context.Context, obj any) *core.ApplicationError {
+	if h, ok := obj.(IBeforeReplace); ok && !isNilPointer(obj) {
+		if err := h.BeforeReplace(ctx); err != nil {
+			return hookError("BeforeReplace", err)
+		}
+	}
+	return nil
+}
+
+func afterFind[T any](ctx context.Context, obj *T) *core.ApplicationError {
+	if h, ok := any(obj).(IAfterFind); ok && obj != nil {
+		if err := h.AfterFind(ctx); err != nil {
+			return hookError("AfterFind", err)
+		}
+	}
+	return nil
+}
+
+// afterFindAll chiama AfterFind sui documenti letti.
+func afterFindAll[T any](ctx context.Context, objs []T) *core.ApplicationError {
+	for i := range objs {
+		if err := afterFind(ctx, &objs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterFindAllPtr chiama AfterFind sui documenti letti come puntatori.
+func afterFindAllPtr[T any](ctx context.Context, objs []*T) *core.ApplicationError {
+	for _, obj := range objs {
+		if err := afterFind(ctx, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// beforeUpdate chiama IBeforeUpdate su un nuovo valore zero del documento, mai condiviso tra chiamate.
+func beforeUpdate(ctx context.Context, policy *documentPolicy, update any) *core.ApplicationError {
+	if policy.beforeUpdate {
+		h := reflect.New(policy.hookType).Interface().(IBeforeUpdate)
+		if err := h.BeforeUpdate(ctx, update); err != nil {
+			return hookError("BeforeUpdate", err)
+		}
+	}
+	return nil
+}
+
+// beforeDelete chiama IBeforeDelete come beforeUpdate.
+func beforeDelete(ctx context.Context, policy *documentPolicy, filter IFilter) *core.ApplicationError {
+	if !policy.beforeDelete {
+		return nil
+	}
+	h := reflect.New(policy.hookType).Interface().(IBeforeDelete)
+	filterB, err := buildFilter(filter)
+	if err != nil {
+		return core.TechnicalErrorWithError(err)
+	}
+	if err := h.BeforeDelete(ctx, filterB); err != nil {
+		return hookError("BeforeDelete", err)
+	}
+	return nil
+}
+
+// UpdatedFields restituisce i campi modificati da un documento di update (operatori $set, $inc, ...),
+// da usare in IBeforeUpdate. Una pipeline di update può modificare qualsiasi campo e restituisce errore.
+//
+//	func (Contratto) BeforeUpdate(ctx context.Context, update any) error {
+//		fields, err := coremongo.UpdatedFields(update)
+//		if err != nil {
+//			return err
+//		}
+//		if slices.Contains(fields, "codiceFiscale") {
+//			return core.BusinessErrorWithCodeAndMessage("CONTRATTO-IMMUTABILE", "codice fiscale non modificabile")
+//		}
+//		return nil
+//	}
+func UpdatedFields(update any) ([]string, error) {
+	update, err := updateDocument(update)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := updatePipeline(update); ok {
+		return nil, fmt.Errorf("i campi modificati da una pipeline di update non sono determinabili")
+	}
+	doc, err := bsonD(update)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]string, 0)
+	for _, op := range doc {
+		if !strings.HasPrefix(op.Key, "$") {
+			return nil, fmt.Errorf("update non valido: campo '%s' senza operatore", op.Key)
+		}
+		opFields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("operatore %s non valido: %T", op.Key, op.Value)
+		}
+		for _, f := range opFields {
+			fields = append(fields, f.Key)
+			if op.Key == "$rename" {
+				if to, ok := f.Value.(string); ok {
+					fields = append(fields, to)
+				}
+			}
+		}
+	}
+	return fields, nil
+}
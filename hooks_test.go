@@ -0,0 +1,172 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testHookDoc struct {
+	ID      string `bson:"_id"`
+	Stato   string `bson:"stato"`
+	Fiscale string `bson:"fiscale"`
+	Label   string `bson:"-"`
+}
+
+func (testHookDoc) GetCollectionName(ctx context.Context) string { return "test_hooks" }
+
+func (d *testHookDoc) BeforeInsert(ctx context.Context) error {
+	if d.Fiscale == "" {
+		return errors.New("codice fiscale obbligatorio")
+	}
+	if d.Stato == "" {
+		d.Stato = "BOZZA"
+	}
+	return nil
+}
+
+func (d *testHookDoc) AfterFind(ctx context.Context) error {
+	d.Label = d.ID + "-" + d.Stato
+	return nil
+}
+
+func (testHookDoc) BeforeUpdate(ctx context.Context, update any) error {
+	fields, err := UpdatedFields(update)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(fields, "fiscale") {
+		return core.BusinessErrorWithCodeAndMessage("HOOK-IMMUTABILE", "codice fiscale non modificabile")
+	}
+	return nil
+}
+
+func (testHookDoc) BeforeDelete(ctx context.Context, filter bson.M) error {
+	if len(filter) == 0 {
+		return errors.New("cancellazione senza filtro")
+	}
+	return nil
+}
+
+func TestBeforeInsertHook(t *testing.T) {
+	doc := &testHookDoc{ID: "1", Fiscale: "RSSMRA"}
+	if err := beforeInsert(context.Background(), doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Stato != "BOZZA" {
+		t.Errorf("default non applicato: %+v", doc)
+	}
+	err := beforeInsert(context.Background(), &testHookDoc{ID: "2"})
+	if err == nil || err.Code != "MON-HOOK" {
+		t.Errorf("atteso MON-HOOK, ottenuto %v", err)
+	}
+	if err := beforeInsert(context.Background(), testBulkDoc{ID: "3"}); err != nil {
+		t.Errorf("errore su documento senza hook: %v", err)
+	}
+}
+
+func TestAfterFindHook(t *testing.T) {
+	docs := []testHookDoc{{ID: "1", Stato: "BOZZA"}, {ID: "2", Stato: "FIRMATO"}}
+	if err := afterFindAll(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+	if docs[0].Label != "1-BOZZA" || docs[1].Label != "2-FIRMATO" {
+		t.Errorf("campi derivati non calcolati: %+v", docs)
+	}
+	ptrs := []*testHookDoc{{ID: "3", Stato: "BOZZA"}}
+	if err := afterFindAllPtr(context.Background(), ptrs); err != nil || ptrs[0].Label != "3-BOZZA" {
+		t.Errorf("campi derivati non calcolati: %+v %v", ptrs[0], err)
+	}
+}
+
+func TestBeforeUpdateHook(t *testing.T) {
+	policy := policyOf[testHookDoc]()
+	if err := beforeUpdate(context.Background(), policy, bson.M{"$set": bson.M{"stato": "FIRMATO"}}); err != nil {
+		t.Errorf("update valido rifiutato: %v", err)
+	}
+	err := beforeUpdate(context.Background(), policy, NewUpdate().Set("stato", "FIRMATO").Set("fiscale", "X"))
+	if err == nil || err.Code != "HOOK-IMMUTABILE" {
+		t.Errorf("atteso l'ApplicationError dell'hook, ottenuto %v", err)
+	}
+	if err := beforeUpdate(context.Background(), policyOf[testBulkDoc](), bson.M{"$set": bson.M{"fiscale": "X"}}); err != nil {
+		t.Errorf("hook applicato a un altro tipo: %v", err)
+	}
+	if err := beforeDelete(context.Background(), policyOf[*testHookDoc](), NewQuery("test_hooks")); err == nil || err.Code != "MON-HOOK" {
+		t.Errorf("atteso MON-HOOK per la cancellazione senza filtro, ottenuto %v", err)
+	}
+}
+
+func TestBulkHooks(t *testing.T) {
+	ctx := context.Background()
+	RegisterDocument[testHookDoc](ctx)
+	tests := []struct {
+		name string
+		op   BulkOperation
+		code string
+	}{
+		{name: "insert", op: BulkInsert(&testHookDoc{ID: "1"}), code: "MON-HOOK"},
+		{name: "update one", op: BulkUpdateOne(NewQuery("test_hooks", Raw(bson.M{"_id": "1"})), bson.M{"$set": bson.M{"fiscale": "X"}}), code: "HOOK-IMMUTABILE"},
+		{name: "update many", op: BulkUpdateMany(NewQuery("test_hooks", Raw(bson.M{"_id": "1"})), bson.M{"$set": bson.M{"fiscale": "X"}}), code: "HOOK-IMMUTABILE"},
+		{name: "delete one", op: BulkDeleteOne(NewQuery("test_hooks")), code: "MON-HOOK"},
+		{name: "delete many", op: BulkDeleteMany(NewQuery("test_hooks")), code: "MON-HOOK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.op.build(ctx)
+			var appErr *core.ApplicationError
+			if !errors.As(err, &appErr) || appErr.Code != tt.code {
+				t.Errorf("atteso %s, ottenuto %v", tt.code, err)
+			}
+		})
+	}
+	if _, _, err := BulkInsert(&testHookDoc{ID: "2", Fiscale: "RSSMRA"}).build(ctx); err != nil {
+		t.Errorf("insert valido rifiutato: %v", err)
+	}
+}
+
+func TestUpdatedFields(t *testing.T) {
+	fields, err := UpdatedFields(bson.D{
+		{Key: "$set", Value: bson.D{{Key: "a", Value: 1}, {Key: "b.c", Value: 2}}},
+		{Key: "$rename", Value: bson.D{{Key: "d", Value: "e"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fields, []string{"a", "b.c", "d", "e"}) {
+		t.Errorf("campi errati: %v", fields)
+	}
+	if _, err := UpdatedFields(PipelineUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}})); err == nil {
+		t.Errorf("atteso errore per una pipeline")
+	}
+	if _, err := UpdatedFields(bson.M{"a": 1}); err == nil {
+		t.Errorf("atteso errore per un update senza operatori")
+	}
+}
+
+type testHookStateDoc struct {
+	ID    string `bson:"_id"`
+	calls int
+}
+
+func (testHookStateDoc) GetCollectionName(ctx context.Context) string { return "test_hooks_state" }
+
+func (d *testHookStateDoc) BeforeUpdate(ctx context.Context, update any) error {
+	d.calls++
+	if d.calls > 1 {
+		return errors.New("valore condiviso tra chiamate")
+	}
+	return nil
+}
+
+func TestBeforeUpdateFreshValue(t *testing.T) {
+	policy := policyOf[testHookStateDoc]()
+	for i := 0; i < 3; i++ {
+		if err := beforeUpdate(context.Background(), policy, bson.M{"$set": bson.M{"a": i}}); err != nil {
+			t.Fatalf("chiamata %d: %v", i, err)
+		}
+	}
+}
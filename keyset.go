@@ -0,0 +1,312 @@
+package coremongo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// KeysetRequest descrive una pagina della paginazione keyset (a cursore).
+type KeysetRequest struct {
+	// Sort è l'ordinamento delle pagine; _id viene aggiunto come ultimo criterio se assente.
+	Sort page.SortRequest
+	// PageSize è il numero di documenti per pagina.
+	PageSize int
+	// Token è il NextToken della pagina precedente, vuoto per la prima pagina.
+	Token string
+	// WithTotal richiede il conteggio totale dei documenti del filtro.
+	WithTotal bool
+}
+
+// KeysetPage è una pagina della paginazione keyset.
+type KeysetPage[T any] struct {
+	Items []T
+	// NextToken va passato nella richiesta successiva; è vuoto sull'ultima pagina.
+	NextToken string
+	// TotalItems è il totale dei documenti del filtro, -1 se non richiesto.
+	TotalItems int64
+}
+
+var (
+	keysetKeyMu sync.RWMutex
+	keysetKey   = randomKeysetKey()
+)
+
+// SetKeysetSigningKey imposta la chiave HMAC con cui vengono firmati i token di paginazione.
+// La chiave di default è casuale e vale solo per il processo corrente: con più istanze
+// dell'applicazione va impostata la stessa chiave su tutte.
+func SetKeysetSigningKey(key []byte) {
+	keysetKeyMu.Lock()
+	defer keysetKeyMu.Unlock()
+	keysetKey = append([]byte(nil), key...)
+}
+
+func randomKeysetKey() []byte {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key
+}
+
+// keysetToken è il contenuto del token: l'impronta dell'ordinamento e i valori delle chiavi
+// di ordinamento dell'ultimo documento della pagina, _id compreso.
+type keysetToken struct {
+	Sort   string          `bson:"s"`
+	Values []bson.RawValue `bson:"v"`
+}
+
+// GetKeysetPageByFilter restituisce una pagina di documenti con la paginazione keyset: invece di
+// skip/limit usa i valori delle chiavi di ordinamento dell'ultimo documento della pagina precedente,
+// quindi le prestazioni non dipendono dal numero di pagina e le pagine restano stabili con scritture
+// concorrenti. Il conteggio totale viene eseguito solo se richiesto.
+func GetKeysetPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, req KeysetRequest, opts ...options.Lister[options.FindOptions]) (*KeysetPage[T], *core.ApplicationError) {
+	return getKeysetPageByFilter[T](ctx, ms, filter.GetFilterCollectionName(ctx), filter, req, opts...)
+}
+
+func getKeysetPageByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, collectionName string, filter IFilter, req KeysetRequest, opts ...options.Lister[options.FindOptions]) (*KeysetPage[T], *core.ApplicationError) {
+	if req.PageSize <= 0 {
+		return nil, core.BusinessErrorWithCodeAndMessage("MON-KEYSET", "page size non valida")
+	}
+	collection := ms.GetCollection(collectionName, "")
+
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	filterB = excludeDeleted(collectionName, filter, filterB)
+	collation := filterCollation(filter)
+
+	result := &KeysetPage[T]{TotalItems: -1}
+	if req.WithTotal {
+		countB, errC := countFilter(filterB)
+		if errC != nil {
+			return nil, core.TechnicalErrorWithCodeAndMessage("MON-GEOCOUNT", errC.Error())
+		}
+		totalItems, errCount := collection.CountDocuments(ctx, countB, options.Count().SetCollation(collation))
+		if errCount != nil {
+			return nil, core.TechnicalErrorWithError(errCount)
+		}
+		result.TotalItems = totalItems
+	}
+
+	sortFields := keysetSort(req.Sort)
+	fingerprint, errF := keysetFingerprint(collectionName, filterB, sortFields)
+	if errF != nil {
+		return nil, core.TechnicalErrorWithError(errF)
+	}
+	query := filterB
+	if req.Token != "" {
+		values, errT := decodeKeysetToken(req.Token, fingerprint)
+		if errT != nil {
+			return nil, core.BusinessErrorWithCodeAndMessage("MON-KEYSET-TOKEN", errT.Error())
+		}
+		after, errA := keysetCondition(sortFields, values)
+		if errA != nil {
+			return nil, core.BusinessErrorWithCodeAndMessage("MON-KEYSET-TOKEN", errA.Error())
+		}
+		query = after
+		if len(filterB) > 0 {
+			query = bson.M{"$and": bson.A{filterB, after}}
+		}
+	}
+
+	// La proiezione del documento vista deve comprendere i campi di ordinamento, letti per il token
+	sortPaths := make([]string, 0, len(sortFields))
+	for _, f := range sortFields {
+		sortPaths = append(sortPaths, f.Field)
+	}
+	if projection := viewProjection[T]().including(sortPaths...); projection != nil {
+		opts = append([]options.Lister[options.FindOptions]{projection.FindOptions()}, opts...)
+	}
+
+	// Le opzioni della paginazione vanno dopo quelle del chiamante: ordinamento e limite non sono modificabili
+	opts = append(opts, options.Find().
+		SetCollation(collation).
+		SetSort(SortToBson(sortFields)).
+		SetLimit(int64(req.PageSize)+1))
+	cursor, errFind := collection.Find(ctx, query, opts...)
+	if errFind != nil {
+		return nil, core.TechnicalErrorWithError(errFind)
+	}
+	defer cursor.Close(ctx)
+
+	var last bson.Raw
+	result.Items = make([]T, 0, req.PageSize)
+	for cursor.Next(ctx) {
+		if len(result.Items) == req.PageSize {
+			// Il documento in più indica che esiste una pagina successiva
+			token, errT := encodeKeysetToken(last, sortFields, fingerprint)
+			if errT != nil {
+				return nil, core.TechnicalErrorWithError(errT)
+			}
+			result.NextToken = token
+			break
+		}
+		var obj T
+		if errDecode := cursor.Decode(&obj); errDecode != nil {
+			return nil, core.TechnicalErrorWithError(errDecode)
+		}
+		if errH := afterFind(ctx, &obj); errH != nil {
+			return nil, errH
+		}
+		result.Items = append(result.Items, obj)
+		last = append(last[:0], cursor.Current...)
+	}
+	if errCur := cursor.Err(); errCur != nil {
+		return nil, core.TechnicalErrorWithError(errCur)
+	}
+
+	return result, nil
+}
+
+// keysetSort aggiunge _id come ultimo criterio di ordinamento, per rendere l'ordine totale.
+func keysetSort(sort page.SortRequest) page.SortRequest {
+	fields := make(page.SortRequest, 0, len(sort)+1)
+	for _, f := range sort {
+		fields = append(fields, f)
+		if f.Field == "_id" {
+			return fields
+		}
+	}
+	var id page.SortField
+	id.Field = "_id"
+	id.Dir = 1
+	if len(sort) > 0 {
+		id.Dir = sort[len(sort)-1].Dir
+	}
+	return append(fields, id)
+}
+
+// keysetFingerprint identifica collection, filtro e ordinamento, così che un token non possa essere
+// riutilizzato con un filtro o un ordinamento diversi. Il filtro entra come hash della sua forma
+// JSON con le chiavi ordinate, indipendente dall'ordine di iterazione di bson.M.
+func keysetFingerprint(collection string, filterB bson.M, sort page.SortRequest) (string, error) {
+	raw, err := bson.MarshalExtJSON(bson.M{"f": filterB}, true, false)
+	if err != nil {
+		return "", err
+	}
+	var canonical any
+	if err := json.Unmarshal(raw, &canonical); err != nil {
+		return "", err
+	}
+	sorted, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(sorted)
+
+	var sb strings.Builder
+	sb.WriteString(collection)
+	for _, f := range sort {
+		fmt.Fprintf(&sb, "|%s:%d", f.Field, int(f.Dir))
+	}
+	sb.WriteString("|" + base64.RawURLEncoding.EncodeToString(sum[:16]))
+	return sb.String(), nil
+}
+
+// keysetCondition restituisce la condizione dei documenti successivi ai valori indicati:
+//
+//	{$or: [{f1: {$gt: v1}}, {f1: v1, f2: {$gt: v2}}, ...]}
+//
+// con $lt al posto di $gt per i campi in ordine decrescente. Un valore null (o un campo assente)
+// precede ogni altro valore nell'ordinamento ma non è confrontabile con $gt/$lt: in ordine crescente
+// lo seguono i documenti con il campo valorizzato ($ne: null), in ordine decrescente nessuno; dopo un
+// valore non null in ordine decrescente seguono anche i documenti con il campo null o assente
+// (tranne che per _id, sempre valorizzato).
+func keysetCondition(sort page.SortRequest, values []bson.RawValue) (bson.M, error) {
+	if len(values) != len(sort) {
+		return nil, errors.New("token di paginazione non coerente con l'ordinamento")
+	}
+	or := make(bson.A, 0, len(sort))
+	for i, f := range sort {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			// L'uguaglianza con null comprende anche i documenti senza il campo
+			clause[sort[j].Field] = values[j]
+		}
+		descending := int(f.Dir) < 0
+		switch {
+		case isNullKeysetValue(values[i]) && descending:
+			// Nessun valore segue null in ordine decrescente
+			continue
+		case isNullKeysetValue(values[i]):
+			clause[f.Field] = bson.M{"$ne": nil}
+		case descending && f.Field != "_id":
+			clause["$or"] = bson.A{bson.M{f.Field: bson.M{"$lt": values[i]}}, bson.M{f.Field: nil}}
+		case descending:
+			clause[f.Field] = bson.M{"$lt": values[i]}
+		default:
+			clause[f.Field] = bson.M{"$gt": values[i]}
+		}
+		or = append(or, clause)
+	}
+	return bson.M{"$or": or}, nil
+}
+
+func isNullKeysetValue(v bson.RawValue) bool {
+	return v.Type == bson.TypeNull || v.Type == bson.TypeUndefined
+}
+
+func encodeKeysetToken(last bson.Raw, sort page.SortRequest, fingerprint string) (string, error) {
+	token := keysetToken{Sort: fingerprint, Values: make([]bson.RawValue, 0, len(sort))}
+	for _, f := range sort {
+		value, err := last.LookupErr(strings.Split(f.Field, ".")...)
+		if err != nil {
+			// Un campo assente viene confrontato come null
+			value = bson.RawValue{Type: bson.TypeNull}
+		}
+		token.Values = append(token.Values, value)
+	}
+	payload, err := bson.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signKeyset(payload)), nil
+}
+
+func decodeKeysetToken(token string, fingerprint string) ([]bson.RawValue, error) {
+	invalid := errors.New("token di paginazione non valido")
+	encPayload, encSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, invalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encSignature)
+	if err != nil || !hmac.Equal(signature, signKeyset(payload)) {
+		return nil, invalid
+	}
+	var t keysetToken
+	if err := bson.Unmarshal(payload, &t); err != nil {
+		return nil, invalid
+	}
+	if t.Sort != fingerprint {
+		return nil, errors.New("token di paginazione non coerente con il filtro o l'ordinamento")
+	}
+	return t.Values, nil
+}
+
+func signKeyset(payload []byte) []byte {
+	keysetKeyMu.RLock()
+	defer keysetKeyMu.RUnlock()
+	mac := hmac.New(sha256.New, keysetKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
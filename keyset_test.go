@@ -0,0 +1,110 @@
+package coremongo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestKeysetSort(t *testing.T) {
+	sort := keysetSort(page.SortRequest{{Field: "name", Dir: -1}})
+	if len(sort) != 2 || sort[1].Field != "_id" || int(sort[1].Dir) != -1 {
+		t.Fatalf("atteso _id decrescente come ultimo criterio, ottenuto %+v", sort)
+	}
+
+	sort = keysetSort(page.SortRequest{{Field: "_id", Dir: 1}, {Field: "name", Dir: 1}})
+	if len(sort) != 1 {
+		t.Fatalf("i criteri dopo _id vanno ignorati, ottenuto %+v", sort)
+	}
+}
+
+func TestKeysetToken(t *testing.T) {
+	sort := keysetSort(page.SortRequest{{Field: "address.city", Dir: 1}, {Field: "age", Dir: -1}})
+	filterB := bson.M{"stato": "ATTIVO", "age": bson.M{"$gte": 18, "$lt": 99}}
+	fingerprint := mustKeysetFingerprint(t, "clienti", filterB, sort)
+	last, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: "c-42"},
+		{Key: "address", Value: bson.D{{Key: "city", Value: "Roma"}}},
+		{Key: "age", Value: int32(30)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := encodeKeysetToken(last, sort, fingerprint)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	values, err := decodeKeysetToken(token, fingerprint)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(values) != 3 || values[0].StringValue() != "Roma" || values[1].Int32() != 30 || values[2].StringValue() != "c-42" {
+		t.Fatalf("valori del token errati: %v", values)
+	}
+
+	condition, err := keysetCondition(sort, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, condition, `{"$or": [
+		{"address.city": {"$gt": "Roma"}},
+		{"address.city": "Roma", "$or": [{"age": {"$lt": 30}}, {"age": null}]},
+		{"address.city": "Roma", "age": 30, "_id": {"$lt": "c-42"}}
+	]}`)
+
+	if _, err := decodeKeysetToken(token, mustKeysetFingerprint(t, "clienti", filterB, sort[:1])); err == nil {
+		t.Error("atteso errore per token usato con un ordinamento diverso")
+	}
+	if _, err := decodeKeysetToken(token, mustKeysetFingerprint(t, "clienti", bson.M{"stato": "CHIUSO"}, sort)); err == nil {
+		t.Error("atteso errore per token usato con un filtro diverso")
+	}
+	// L'impronta non dipende dall'ordine di iterazione delle mappe
+	for i := 0; i < 20; i++ {
+		again := mustKeysetFingerprint(t, "clienti", bson.M{"age": bson.M{"$lt": 99, "$gte": 18}, "stato": "ATTIVO"}, sort)
+		if again != fingerprint {
+			t.Fatalf("impronta instabile: %s != %s", again, fingerprint)
+		}
+	}
+	payload, signature, _ := strings.Cut(token, ".")
+	tampered := payload + "." + signature[1:] + "A"
+	if _, err := decodeKeysetToken(tampered, fingerprint); err == nil {
+		t.Error("atteso errore per token alterato")
+	}
+	if _, err := decodeKeysetToken("non-valido", fingerprint); err == nil {
+		t.Error("atteso errore per token non valido")
+	}
+}
+
+func mustKeysetFingerprint(t *testing.T, collection string, filterB bson.M, sort page.SortRequest) string {
+	t.Helper()
+	fingerprint, err := keysetFingerprint(collection, filterB, sort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fingerprint
+}
+
+func TestKeysetConditionNull(t *testing.T) {
+	null := bson.RawValue{Type: bson.TypeNull}
+	id := rawValueOf("c-42")
+
+	condition, err := keysetCondition(page.SortRequest{{Field: "city", Dir: 1}, {Field: "_id", Dir: 1}}, []bson.RawValue{null, id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, condition, `{"$or": [
+		{"city": {"$ne": null}},
+		{"city": null, "_id": {"$gt": "c-42"}}
+	]}`)
+
+	condition, err = keysetCondition(page.SortRequest{{Field: "city", Dir: -1}, {Field: "_id", Dir: -1}}, []bson.RawValue{null, id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, condition, `{"$or": [
+		{"city": null, "_id": {"$lt": "c-42"}}
+	]}`)
+}
@@ -0,0 +1,17 @@
+package coremongo
+
+import (
+	"context"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+)
+
+// principalOf legge dal contesto l'utente della richiesta
+var principalOf = core.GetPrincipal
+
+// principal restituisce l'utente che esegue l'operazione, registrato nei campi di tracciamento delle
+// scritture (createdBy, updatedBy, deletedBy) e nello storico: è il principal che go-core-app associa
+// al contesto della richiesta, vuoto se il contesto non ne ha uno (es. job senza utente).
+func principal(ctx context.Context) string {
+	return principalOf(ctx)
+}
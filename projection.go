@@ -0,0 +1,187 @@
+package coremongo
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// IView è implementato dai documenti "vista", struct che contengono solo una parte dei campi della
+// collection: le funzioni di lettura di collection.go proiettano solo i campi della struct, letti dai tag bson.
+//
+//	type ClienteSintesi struct {
+//		ID   string `bson:"_id"`
+//		Nome string `bson:"nome"`
+//	}
+//
+//	func (ClienteSintesi) GetCollectionName(ctx context.Context) string { return "clienti" }
+//	func (ClienteSintesi) ProjectionView()                              {}
+type IView interface {
+	ProjectionView()
+}
+
+// Projection è la proiezione di una find. Si ottiene da una struct vista (ProjectionOf)
+// o da una lista di campi da includere (Include) o escludere (Exclude).
+type Projection bson.D
+
+// Include restituisce la proiezione dei soli campi indicati (più _id, se non escluso esplicitamente).
+func Include(fields ...string) Projection {
+	p := make(Projection, 0, len(fields))
+	for _, f := range fields {
+		p = append(p, bson.E{Key: f, Value: 1})
+	}
+	return p
+}
+
+// Exclude restituisce la proiezione di tutti i campi tranne quelli indicati.
+func Exclude(fields ...string) Projection {
+	p := make(Projection, 0, len(fields))
+	for _, f := range fields {
+		p = append(p, bson.E{Key: f, Value: 0})
+	}
+	return p
+}
+
+// FindOptions restituisce la proiezione come opzione di Find (GetObjectsByFilter, GetPageByFilter, ...).
+func (p Projection) FindOptions() options.Lister[options.FindOptions] {
+	return options.Find().SetProjection(p.bson())
+}
+
+// FindOneOptions restituisce la proiezione come opzione di FindOne (GetObjectById, GetObjectByFilter).
+func (p Projection) FindOneOptions() options.Lister[options.FindOneOptions] {
+	return options.FindOne().SetProjection(p.bson())
+}
+
+func (p Projection) bson() bson.D {
+	return bson.D(p)
+}
+
+// isExclusion indica se la proiezione esclude campi invece di includerli (_id escluso).
+func (p Projection) isExclusion() bool {
+	for _, e := range p {
+		if e.Key == "_id" {
+			continue
+		}
+		if v, ok := e.Value.(int); ok && v == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withTextScore aggiunge alla proiezione il punteggio della ricerca full-text.
+func (p Projection) withTextScore() Projection {
+	out := make(Projection, 0, len(p)+1)
+	for _, e := range p {
+		if e.Key != TextScoreField {
+			out = append(out, e)
+		}
+	}
+	return append(out, bson.E{Key: TextScoreField, Value: textScoreMeta})
+}
+
+// including aggiunge a una proiezione di inclusione i campi indicati, se non già coperti.
+// Una proiezione nil (tutti i campi) o di esclusione viene restituita così com'è.
+func (p Projection) including(fields ...string) Projection {
+	if p == nil || p.isExclusion() {
+		return p
+	}
+	out := slices.Clone(p)
+	for _, f := range fields {
+		covered := slices.ContainsFunc(out, func(e bson.E) bool {
+			return e.Key == f || strings.HasPrefix(f, e.Key+".")
+		})
+		if !covered {
+			out = append(out, bson.E{Key: f, Value: 1})
+		}
+	}
+	return out
+}
+
+// projections contiene le proiezioni già calcolate per tipo
+var projections sync.Map
+
+// ProjectionOf restituisce la proiezione dei campi della struct T secondo i tag bson:
+// i campi con tag "-" sono esclusi, quelli senza tag usano il nome in minuscolo come il driver,
+// le struct con opzione inline contribuiscono con i propri campi. Una struct con una mappa inline
+// può contenere campi qualsiasi e restituisce una proiezione nil (tutti i campi).
+func ProjectionOf[T any]() (Projection, error) {
+	return projectionOfType(reflect.TypeFor[T]())
+}
+
+func projectionOfType(typ reflect.Type) (Projection, error) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if cached, ok := projections.Load(typ); ok {
+		return cached.(Projection), nil
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("la proiezione richiede una struct, ricevuto %s", typ)
+	}
+	p := Projection{}
+	if !appendProjectionFields(&p, typ) {
+		p = nil
+	}
+	projections.Store(typ, p)
+	return p, nil
+}
+
+// appendProjectionFields aggiunge i campi della struct alla proiezione; restituisce false
+// se la struct ha una mappa inline e non è quindi proiettabile.
+func appendProjectionFields(p *Projection, typ reflect.Type) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, inline := bsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		if inline {
+			ft := field.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() != reflect.Struct || !appendProjectionFields(p, ft) {
+				return false
+			}
+			continue
+		}
+		if !slices.ContainsFunc(*p, func(e bson.E) bool { return e.Key == name }) {
+			*p = append(*p, bson.E{Key: name, Value: 1})
+		}
+	}
+	return true
+}
+
+// bsonFieldName restituisce il nome del campo nel documento secondo il tag bson ("-" se escluso),
+// con il nome in minuscolo come il driver in assenza di tag, e se il campo ha l'opzione inline.
+func bsonFieldName(field reflect.StructField) (string, bool) {
+	name, opts, _ := strings.Cut(field.Tag.Get("bson"), ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, slices.Contains(strings.Split(opts, ","), "inline")
+}
+
+// viewProjection restituisce la proiezione di T se è una vista (IView), altrimenti nil.
+func viewProjection[T any]() Projection {
+	var obj T
+	if _, ok := any(obj).(IView); !ok {
+		if _, ok := any(&obj).(IView); !ok {
+			return nil
+		}
+	}
+	p, err := ProjectionOf[T]()
+	if err != nil {
+		return nil
+	}
+	return p
+}
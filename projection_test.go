@@ -0,0 +1,83 @@
+package coremongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testAudit struct {
+	CreatedBy string `bson:"createdBy"`
+}
+
+type testCustomerSummary struct {
+	ID       string `bson:"_id"`
+	Name     string `bson:"name,omitempty"`
+	Email    string
+	Internal string    `bson:"-"`
+	Audit    testAudit `bson:",inline"`
+	internal string
+}
+
+func (testCustomerSummary) GetCollectionName(ctx context.Context) string { return "customers" }
+func (testCustomerSummary) ProjectionView()                              {}
+
+type testInlineMap struct {
+	ID    string         `bson:"_id"`
+	Extra map[string]any `bson:",inline"`
+}
+
+func TestProjectionOf(t *testing.T) {
+	p, err := ProjectionOf[testCustomerSummary]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Projection{{Key: "_id", Value: 1}, {Key: "name", Value: 1}, {Key: "email", Value: 1}, {Key: "createdBy", Value: 1}}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("proiezione errata: %v", p)
+	}
+	if !reflect.DeepEqual(viewProjection[testCustomerSummary](), want) {
+		t.Error("la vista deve usare la proiezione della struct")
+	}
+	if viewProjection[testAudit]() != nil {
+		t.Error("un documento che non è una vista non va proiettato")
+	}
+
+	p, err = ProjectionOf[testInlineMap]()
+	if err != nil || p != nil {
+		t.Fatalf("una mappa inline richiede tutti i campi, ottenuto %v, %v", p, err)
+	}
+	if _, err := ProjectionOf[string](); err == nil {
+		t.Error("atteso errore per un tipo non struct")
+	}
+}
+
+func TestProjectionIncludeExclude(t *testing.T) {
+	include := Include("name", "address")
+	if include.isExclusion() {
+		t.Error("Include non è una proiezione di esclusione")
+	}
+	if !Exclude("password").isExclusion() {
+		t.Error("Exclude è una proiezione di esclusione")
+	}
+
+	got := include.including("address.city", "_id", "age").withTextScore()
+	want := Projection{
+		{Key: "name", Value: 1},
+		{Key: "address", Value: 1},
+		{Key: "_id", Value: 1},
+		{Key: "age", Value: 1},
+		{Key: TextScoreField, Value: textScoreMeta},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("proiezione errata: %v", got)
+	}
+	if got := Exclude("password").including("name"); len(got) != 1 {
+		t.Errorf("una proiezione di esclusione non va estesa: %v", got)
+	}
+	if got := Projection(nil).withTextScore(); !reflect.DeepEqual(got.bson(), bson.D{{Key: TextScoreField, Value: textScoreMeta}}) {
+		t.Errorf("proiezione del punteggio errata: %v", got)
+	}
+}
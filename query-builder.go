@@ -0,0 +1,244 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// IBsonFilter è implementato dai filtri che costruiscono direttamente il proprio bson
+// invece di essere letti tramite i tag della struct (es. Query).
+type IBsonFilter interface {
+	IFilter
+	Bson() (bson.M, error)
+}
+
+// Condition è una condizione costruita a runtime con Where, And, Or, Nor o Raw.
+// La condizione zero è vuota e viene ignorata.
+type Condition struct {
+	m   bson.M
+	err error
+}
+
+// FieldExpr è il campo su cui costruire una Condition, ottenuto con Where.
+type FieldExpr struct {
+	path string
+}
+
+// Where restituisce il campo indicato, anche con percorso puntato (es. "address.city").
+//
+//	coremongo.Where("status").Eq("A").And(coremongo.Where("age").Gt(3))
+func Where(path string) FieldExpr {
+	return FieldExpr{path: path}
+}
+
+// Raw restituisce una condizione a partire da un bson già costruito (es. un filtro json decodificato).
+func Raw(m bson.M) Condition {
+	return Condition{m: m}
+}
+
+// Op applica al campo un operatore registrato nel filter builder, inclusi quelli personalizzati.
+func (f FieldExpr) Op(operator string, value any) Condition {
+	handler, topLevel, ok := lookupOperator(operator)
+	if !ok {
+		return Condition{err: fmt.Errorf("operatore '%s' non supportato per il campo '%s'", operator, f.path)}
+	}
+	opFilter, err := handler(operator, value)
+	if err != nil {
+		return Condition{err: fmt.Errorf("errore per campo '%s' operatore '%s': %w", f.path, operator, err)}
+	}
+	if len(opFilter) == 0 {
+		return Condition{}
+	}
+	if topLevel {
+		return Condition{m: opFilter}
+	}
+	return Condition{m: bson.M{f.path: opFilter}}
+}
+
+func (f FieldExpr) Eq(value any) Condition         { return f.Op("$eq", value) }
+func (f FieldExpr) Ne(value any) Condition         { return f.Op("$ne", value) }
+func (f FieldExpr) Gt(value any) Condition         { return f.Op("$gt", value) }
+func (f FieldExpr) Gte(value any) Condition        { return f.Op("$gte", value) }
+func (f FieldExpr) Lt(value any) Condition         { return f.Op("$lt", value) }
+func (f FieldExpr) Lte(value any) Condition        { return f.Op("$lte", value) }
+func (f FieldExpr) In(values any) Condition        { return f.Op("$in", values) }
+func (f FieldExpr) Nin(values any) Condition       { return f.Op("$nin", values) }
+func (f FieldExpr) All(values any) Condition       { return f.Op("$all", values) }
+func (f FieldExpr) Exists(exists bool) Condition   { return f.Op("$exists", exists) }
+func (f FieldExpr) Size(size int) Condition        { return f.Op("$size", size) }
+func (f FieldExpr) Regex(pattern string) Condition { return f.Op("$regex", pattern) }
+func (f FieldExpr) Contains(s string) Condition    { return f.Op("$contains", s) }
+func (f FieldExpr) IContains(s string) Condition   { return f.Op("$icontains", s) }
+func (f FieldExpr) StartsWith(s string) Condition  { return f.Op("$startswith", s) }
+func (f FieldExpr) EndsWith(s string) Condition    { return f.Op("$endswith", s) }
+func (f FieldExpr) IEq(s string) Condition         { return f.Op("$ieq", s) }
+func (f FieldExpr) Between(min, max any) Condition { return f.Op("$between", []any{min, max}) }
+
+// ElemMatch filtra gli elementi di un array di sotto-documenti; i percorsi della condizione
+// sono relativi all'elemento.
+func (f FieldExpr) ElemMatch(c Condition) Condition {
+	if c.err != nil {
+		return c
+	}
+	return Condition{m: bson.M{f.path: bson.M{"$elemMatch": c.bsonOrEmpty()}}}
+}
+
+// And restituisce la condizione in AND con le altre.
+func (c Condition) And(others ...Condition) Condition {
+	return combineConditions("$and", append([]Condition{c}, others...))
+}
+
+// Or restituisce la condizione in OR con le altre.
+func (c Condition) Or(others ...Condition) Condition {
+	return combineConditions("$or", append([]Condition{c}, others...))
+}
+
+// Nor restituisce la condizione in NOR con le altre.
+func (c Condition) Nor(others ...Condition) Condition {
+	return combineConditions("$nor", append([]Condition{c}, others...))
+}
+
+// M restituisce la condizione come bson.M.
+func (c Condition) M() (bson.M, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.bsonOrEmpty(), nil
+}
+
+// D restituisce la condizione come bson.D con le chiavi in ordine alfabetico.
+func (c Condition) D() (bson.D, error) {
+	m, err := c.M()
+	if err != nil {
+		return nil, err
+	}
+	return bsonMToD(m), nil
+}
+
+func (c Condition) bsonOrEmpty() bson.M {
+	if c.m == nil {
+		return bson.M{}
+	}
+	return c.m
+}
+
+func (c Condition) isEmpty() bool {
+	return c.err == nil && len(c.m) == 0
+}
+
+// combineConditions unisce le condizioni non vuote con l'operatore logico indicato.
+// Una sola condizione non vuota viene restituita così com'è.
+func combineConditions(operator string, conditions []Condition) Condition {
+	members := bson.A{}
+	for _, c := range conditions {
+		if c.err != nil {
+			return c
+		}
+		if c.isEmpty() {
+			continue
+		}
+		members = append(members, c.m)
+	}
+	switch {
+	case len(members) == 0:
+		return Condition{}
+	case len(members) == 1 && operator != "$nor":
+		return Condition{m: members[0].(bson.M)}
+	default:
+		return Condition{m: bson.M{operator: members}}
+	}
+}
+
+// Query è un filtro costruito a runtime che implementa IFilter e può quindi essere usato
+// con tutte le funzioni di collection.go. Può partire da una struct taggata (QueryFrom)
+// a cui aggiungere altre condizioni.
+type Query struct {
+	collection string
+	base       IFilter
+	conditions []Condition
+}
+
+// NewQuery restituisce una Query sulla collection indicata con le condizioni in AND.
+func NewQuery(collection string, conditions ...Condition) *Query {
+	return &Query{collection: collection, conditions: conditions}
+}
+
+// QueryFrom restituisce una Query che estende il filtro indicato (es. una struct taggata)
+// con le condizioni in AND. La collection è quella del filtro.
+func QueryFrom(filter IFilter, conditions ...Condition) *Query {
+	return &Query{base: filter, conditions: conditions}
+}
+
+// And aggiunge le condizioni in AND.
+func (q *Query) And(conditions ...Condition) *Query {
+	q.conditions = append(q.conditions, conditions...)
+	return q
+}
+
+// Or aggiunge una clausola $or con le condizioni indicate.
+func (q *Query) Or(conditions ...Condition) *Query {
+	q.conditions = append(q.conditions, combineConditions("$or", conditions))
+	return q
+}
+
+// Nor aggiunge una clausola $nor con le condizioni indicate.
+func (q *Query) Nor(conditions ...Condition) *Query {
+	q.conditions = append(q.conditions, combineConditions("$nor", conditions))
+	return q
+}
+
+func (q *Query) GetFilterCollectionName(ctx context.Context) string {
+	if q.base != nil {
+		return q.base.GetFilterCollectionName(ctx)
+	}
+	return q.collection
+}
+
+func (q *Query) unwrap() IFilter {
+	if q == nil || q.base == nil {
+		return nil
+	}
+	return q.base
+}
+
+// Bson restituisce il filtro della Query: il filtro di base e le condizioni sono messi in AND.
+func (q *Query) Bson() (bson.M, error) {
+	if q == nil {
+		return nil, fmt.Errorf("input non può essere un puntatore nil")
+	}
+	conditions := make([]Condition, 0, len(q.conditions)+1)
+	if q.base != nil {
+		baseFilter, err := buildFilter(q.base)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, Condition{m: baseFilter})
+	}
+	conditions = append(conditions, q.conditions...)
+	return combineConditions("$and", conditions).M()
+}
+
+// BsonD restituisce il filtro della Query come bson.D con le chiavi in ordine alfabetico.
+func (q *Query) BsonD() (bson.D, error) {
+	m, err := q.Bson()
+	if err != nil {
+		return nil, err
+	}
+	return bsonMToD(m), nil
+}
+
+func bsonMToD(m bson.M) bson.D {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	d := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		d = append(d, bson.E{Key: k, Value: m[k]})
+	}
+	return d
+}
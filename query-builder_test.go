@@ -0,0 +1,84 @@
+package coremongo
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   *Query
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "query vuota",
+			query: NewQuery("customers"),
+			want:  `{}`,
+		},
+		{
+			name:  "condizione singola",
+			query: NewQuery("customers", Where("status").Eq("A")),
+			want:  `{"status":{"$eq":"A"}}`,
+		},
+		{
+			name:  "and e or",
+			query: NewQuery("customers", Where("status").Eq("A").And(Where("age").Gt(3)).Or(Where("vip").Eq(true))),
+			want:  `{"$or":[{"$and":[{"status":{"$eq":"A"}},{"age":{"$gt":3}}]},{"vip":{"$eq":true}}]}`,
+		},
+		{
+			name: "or di query e condizioni vuote ignorate",
+			query: NewQuery("customers").
+				Or(Where("name").Contains("a.b"), Condition{}).
+				And(Where("lines").ElemMatch(Where("sku").Eq("X").And(Where("qty").Gte(2)))),
+			want: `{"$and":[{"name":{"$regex":"a\\.b"}},{"lines":{"$elemMatch":{"$and":[{"sku":{"$eq":"X"}},{"qty":{"$gte":2}}]}}}]}`,
+		},
+		{
+			name:  "estensione di una struct taggata",
+			query: QueryFrom(testGroupFilter{Status: "A"}, Raw(bson.M{"deleted": bson.M{"$ne": true}})),
+			want:  `{"$and":[{"status":{"$eq":"A"}},{"deleted":{"$ne":true}}]}`,
+		},
+		{
+			name:    "operatore sconosciuto",
+			query:   NewQuery("customers", Where("a").Op("$equal", 1)),
+			wantErr: true,
+		},
+		{
+			name:    "valore non valido",
+			query:   NewQuery("customers", Where("a").In("x")),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := buildFilter(tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("atteso errore")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildFilter: %v", err)
+			}
+			assertFilterJSON(t, filter, tt.want)
+		})
+	}
+}
+
+func TestQueryCollectionName(t *testing.T) {
+	ctx := context.Background()
+	if name := NewQuery("customers").GetFilterCollectionName(ctx); name != "customers" {
+		t.Errorf("collection inattesa %s", name)
+	}
+	if name := QueryFrom(testOrderFilter{}).GetFilterCollectionName(ctx); name != "orders" {
+		t.Errorf("collection inattesa %s", name)
+	}
+	q := QueryFrom(testCollationFilter{Name: "x"})
+	if c := filterCollation(q); c == nil || c.Locale != "it" {
+		t.Errorf("collation non ereditata: %+v", c)
+	}
+}
@@ -0,0 +1,65 @@
+package coremongo
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// RangeValue sono i tipi ammessi come estremi di un Range.
+type RangeValue interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64 | time.Time
+}
+
+// Range è un intervallo su date o numeri da usare come campo di una struct filtro:
+//
+//	Creazione coremongo.Range[time.Time] `field:"createdAt"`
+//
+// Di default From è incluso ($gte) e To è escluso ($lt); FromExclusive e ToInclusive
+// cambiano il comportamento dei singoli estremi. Un estremo nil non viene applicato e un
+// Range senza estremi non produce alcuna condizione. Gli estremi time.Time vengono convertiti in UTC.
+type Range[T RangeValue] struct {
+	From          *T   `json:"from,omitempty" yaml:"from,omitempty"`
+	To            *T   `json:"to,omitempty" yaml:"to,omitempty"`
+	FromExclusive bool `json:"fromExclusive,omitempty" yaml:"fromExclusive,omitempty"`
+	ToInclusive   bool `json:"toInclusive,omitempty" yaml:"toInclusive,omitempty"`
+}
+
+// NewRange restituisce un Range con From incluso e To escluso.
+func NewRange[T RangeValue](from, to T) Range[T] {
+	return Range[T]{From: &from, To: &to}
+}
+
+// rangeCondition è implementata dai tipi che il filter builder espande in una condizione di intervallo.
+type rangeCondition interface {
+	rangeCondition() bson.M
+}
+
+func (r Range[T]) rangeCondition() bson.M {
+	condition := bson.M{}
+	if r.From != nil {
+		operator := "$gte"
+		if r.FromExclusive {
+			operator = "$gt"
+		}
+		condition[operator] = rangeBound(*r.From)
+	}
+	if r.To != nil {
+		operator := "$lt"
+		if r.ToInclusive {
+			operator = "$lte"
+		}
+		condition[operator] = rangeBound(*r.To)
+	}
+	return condition
+}
+
+// rangeBound normalizza in UTC gli estremi di tipo time.Time.
+func rangeBound[T RangeValue](value T) any {
+	if t, ok := any(value).(time.Time); ok {
+		return t.UTC()
+	}
+	return value
+}
@@ -0,0 +1,236 @@
+package coremongo
+
+import (
+	"context"
+	"iter"
+	"time"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.uber.org/fx"
+)
+
+// Repository raccoglie le operazioni di collection.go sulla collection del documento T,
+// legate una sola volta al linked service e alle opzioni di default. Le operazioni che ricevono
+// solo il filtro usano la collection e i comportamenti di T, non la collection del filtro.
+type Repository[T ICollection] struct {
+	ms          *mongolks.LinkedService
+	findOptions []options.Lister[options.FindOptions]
+}
+
+type repositoryConfig struct {
+	findOptions []options.Lister[options.FindOptions]
+}
+
+// RepositoryOption configura un Repository.
+type RepositoryOption func(*repositoryConfig)
+
+// WithDefaultFindOptions imposta le opzioni applicate a Find e Page prima di quelle della singola chiamata.
+func WithDefaultFindOptions(opts ...options.Lister[options.FindOptions]) RepositoryOption {
+	return func(c *repositoryConfig) {
+		c.findOptions = append(c.findOptions, opts...)
+	}
+}
+
+// NewRepository restituisce il Repository del documento T e registra il documento, vedi RegisterDocument.
+func NewRepository[T ICollection](ms *mongolks.LinkedService, opts ...RepositoryOption) *Repository[T] {
+	cfg := &repositoryConfig{}
+	for _, o := range opts {
+		o(cfg)
+	}
+	RegisterDocument[T](context.Background())
+	return &Repository[T]{ms: ms, findOptions: cfg.findOptions}
+}
+
+// ProvideRepository registra nel container fx il *Repository[T], così che i servizi possano
+// riceverlo direttamente. Richiede il *mongolks.LinkedService fornito da NewService. Il documento T
+// viene registrato all'avvio dell'applicazione, anche se nessun servizio riceve il Repository.
+//
+//	fx.New(coremongo.ProvideRepository[Customer](), ...)
+func ProvideRepository[T ICollection](opts ...RepositoryOption) fx.Option {
+	return fx.Options(
+		fx.Provide(func(ms *mongolks.LinkedService) *Repository[T] {
+			return NewRepository[T](ms, opts...)
+		}),
+		fx.Invoke(func() {
+			RegisterDocument[T](context.Background())
+		}),
+	)
+}
+
+// CollectionName restituisce il nome della collection del documento T.
+func (r *Repository[T]) CollectionName(ctx context.Context) string {
+	return collectionOf[T](ctx)
+}
+
+// LinkedService restituisce il linked service del Repository.
+func (r *Repository[T]) LinkedService() *mongolks.LinkedService {
+	return r.ms
+}
+
+func (r *Repository[T]) Get(ctx context.Context, id string, opts ...options.Lister[options.FindOneOptions]) (*T, *core.ApplicationError) {
+	return GetObjectById[T](ctx, r.ms, id, opts...)
+}
+
+func (r *Repository[T]) FindOne(ctx context.Context, filter IFilter, opts ...options.Lister[options.FindOneOptions]) (*T, *core.ApplicationError) {
+	return GetObjectByFilter[T](ctx, r.ms, filter, opts...)
+}
+
+func (r *Repository[T]) Find(ctx context.Context, filter IFilter, opts ...options.Lister[options.FindOptions]) ([]*T, *core.ApplicationError) {
+	return GetObjectsByFilter[T](ctx, r.ms, filter, r.withFindOptions(opts)...)
+}
+
+func (r *Repository[T]) FindSorted(ctx context.Context, filter IFilter, sort page.SortRequest) ([]*T, *core.ApplicationError) {
+	return GetObjectsByFilterSorted[T](ctx, r.ms, filter, sort)
+}
+
+// Stream restituisce i documenti in streaming, vedi StreamObjectsByFilter.
+func (r *Repository[T]) Stream(ctx context.Context, filter IFilter, batchSize int32, opts ...options.Lister[options.FindOptions]) iter.Seq2[*T, error] {
+	return StreamObjectsByFilter[T](ctx, r.ms, filter, batchSize, r.withFindOptions(opts)...)
+}
+
+func (r *Repository[T]) Page(ctx context.Context, filter IFilter, paging *page.Paging, opts ...options.Lister[options.FindOptions]) ([]T, *core.ApplicationError) {
+	return getPageByFilter[T](ctx, r.ms, r.CollectionName(ctx), filter, paging, r.withFindOptions(opts)...)
+}
+
+// KeysetPage restituisce una pagina con la paginazione keyset, vedi GetKeysetPageByFilter.
+func (r *Repository[T]) KeysetPage(ctx context.Context, filter IFilter, req KeysetRequest, opts ...options.Lister[options.FindOptions]) (*KeysetPage[T], *core.ApplicationError) {
+	return getKeysetPageByFilter[T](ctx, r.ms, r.CollectionName(ctx), filter, req, r.withFindOptions(opts)...)
+}
+
+func (r *Repository[T]) Count(ctx context.Context, filter IFilter) (int64, *core.ApplicationError) {
+	return countDocuments(ctx, r.ms, r.CollectionName(ctx), filter)
+}
+
+// Facets conta i documenti per valore o intervallo dei campi, vedi Facets.
+func (r *Repository[T]) Facets(ctx context.Context, filter IFilter, facets ...Facet) (map[string][]FacetBucket, *core.ApplicationError) {
+	return facetsOf(ctx, r.ms, r.CollectionName(ctx), filter, facets)
+}
+
+func (r *Repository[T]) Insert(ctx context.Context, obj T, opts ...options.Lister[options.InsertOneOptions]) (any, *core.ApplicationError) {
+	return InsertOne(ctx, r.ms, obj, opts...)
+}
+
+func (r *Repository[T]) InsertMany(ctx context.Context, objs []T, opts ...options.Lister[options.InsertManyOptions]) *core.ApplicationError {
+	list := make([]ICollection, 0, len(objs))
+	for _, o := range objs {
+		list = append(list, o)
+	}
+	return InsertMany(ctx, r.ms, list, opts...)
+}
+
+func (r *Repository[T]) Update(ctx context.Context, filter IFilter, update any, opts ...options.Lister[options.UpdateOneOptions]) *core.ApplicationError {
+	_, err := r.UpdateExpect(ctx, filter, update, ExpectModified(1), opts...)
+	return err
+}
+
+// UpdateExpect aggiorna il documento e verifica il risultato, vedi UpdateOneExpect.
+func (r *Repository[T]) UpdateExpect(ctx context.Context, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateOneOptions]) (*WriteResult, *core.ApplicationError) {
+	return updateOneExpect(ctx, r.ms, r.CollectionName(ctx), policyOf[T](), filter, update, expect, opts...)
+}
+
+// UpdateManyExpect aggiorna i documenti e verifica il risultato, vedi UpdateManyExpect.
+func (r *Repository[T]) UpdateManyExpect(ctx context.Context, filter IFilter, update any, expect Expectation, opts ...options.Lister[options.UpdateManyOptions]) (*WriteResult, *core.ApplicationError) {
+	return updateManyExpect(ctx, r.ms, r.CollectionName(ctx), policyOf[T](), filter, update, expect, opts...)
+}
+
+func (r *Repository[T]) UpdateMany(ctx context.Context, filter IFilter, update any, expected int) *core.ApplicationError {
+	_, err := r.UpdateManyExpect(ctx, filter, update, ExpectModified(int64(expected)))
+	return err
+}
+
+func (r *Repository[T]) Replace(ctx context.Context, filter IFilter, obj T, opts ...options.Lister[options.ReplaceOptions]) *core.ApplicationError {
+	return ReplaceOne(ctx, r.ms, filter, obj, opts...)
+}
+
+// ReplaceExpect sostituisce il documento e verifica il risultato, vedi ReplaceOneExpect.
+func (r *Repository[T]) ReplaceExpect(ctx context.Context, filter IFilter, obj T, expect Expectation, opts ...options.Lister[options.ReplaceOptions]) (*WriteResult, *core.ApplicationError) {
+	return ReplaceOneExpect(ctx, r.ms, filter, obj, expect, opts...)
+}
+
+// Upsert sostituisce il documento che soddisfa il filtro o lo inserisce se non esiste.
+func (r *Repository[T]) Upsert(ctx context.Context, filter IFilter, obj T) *core.ApplicationError {
+	return ReplaceOne(ctx, r.ms, filter, obj, options.Replace().SetUpsert(true))
+}
+
+// UpsertByKey inserisce o aggiorna il documento secondo la chiave naturale, vedi Upsert.
+func (r *Repository[T]) UpsertByKey(ctx context.Context, obj T) (*UpsertResult, *core.ApplicationError) {
+	return Upsert(ctx, r.ms, obj)
+}
+
+// UpsertManyByKey inserisce o aggiorna i documenti secondo la chiave naturale, vedi UpsertMany.
+func (r *Repository[T]) UpsertManyByKey(ctx context.Context, objs []T, opts ...BulkOption) ([]UpsertResult, *core.ApplicationError) {
+	return UpsertMany(ctx, r.ms, objs, opts...)
+}
+
+func (r *Repository[T]) Delete(ctx context.Context, filter IFilter, opts ...options.Lister[options.DeleteOneOptions]) *core.ApplicationError {
+	_, err := r.DeleteExpect(ctx, filter, ExpectMatched(1), opts...)
+	return err
+}
+
+// DeleteExpect rimuove il documento e verifica il risultato, vedi DeleteOneExpect.
+func (r *Repository[T]) DeleteExpect(ctx context.Context, filter IFilter, expect Expectation, opts ...options.Lister[options.DeleteOneOptions]) (*WriteResult, *core.ApplicationError) {
+	return deleteOneExpect(ctx, r.ms, r.CollectionName(ctx), policyOf[T](), filter, expect, opts...)
+}
+
+// DeleteManyExpect rimuove i documenti e verifica il risultato, vedi DeleteManyExpect.
+func (r *Repository[T]) DeleteManyExpect(ctx context.Context, filter IFilter, expect Expectation, opts ...options.Lister[options.DeleteManyOptions]) (*WriteResult, *core.ApplicationError) {
+	return deleteManyExpect(ctx, r.ms, r.CollectionName(ctx), policyOf[T](), filter, expect, opts...)
+}
+
+// ReplaceWithRetry modifica il documento con mutate controllando la versione, vedi ReplaceWithRetry.
+func (r *Repository[T]) ReplaceWithRetry(ctx context.Context, filter IFilter, attempts int, mutate func(obj *T) error) (*T, *core.ApplicationError) {
+	return ReplaceWithRetry[T](ctx, r.ms, filter, attempts, mutate)
+}
+
+// History restituisce lo storico del documento, vedi GetHistory.
+func (r *Repository[T]) History(ctx context.Context, id any) ([]HistoryEntry, *core.ApplicationError) {
+	return GetHistory(ctx, r.ms, r.CollectionName(ctx), id)
+}
+
+// GetAsOf ricostruisce il documento com'era al momento indicato, vedi GetObjectAsOf.
+func (r *Repository[T]) GetAsOf(ctx context.Context, id any, at time.Time) (*T, *core.ApplicationError) {
+	return GetObjectAsOf[T](ctx, r.ms, id, at)
+}
+
+// Restore ripristina i documenti cancellati logicamente, vedi Restore.
+func (r *Repository[T]) Restore(ctx context.Context, filter IFilter) (*WriteResult, *core.ApplicationError) {
+	return restore(ctx, r.ms, r.CollectionName(ctx), policyOf[T](), filter)
+}
+
+func (r *Repository[T]) DeleteMany(ctx context.Context, filter IFilter, opts ...options.Lister[options.DeleteManyOptions]) *core.ApplicationError {
+	_, err := r.DeleteManyExpect(ctx, filter, ExpectAny(), opts...)
+	return err
+}
+
+// FindOneAndUpdate aggiorna e restituisce il documento, vedi FindOneAndUpdate.
+func (r *Repository[T]) FindOneAndUpdate(ctx context.Context, filter IFilter, update any, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	return FindOneAndUpdate[T](ctx, r.ms, filter, update, fm)
+}
+
+// FindOneAndReplace sostituisce e restituisce il documento, vedi FindOneAndReplace.
+func (r *Repository[T]) FindOneAndReplace(ctx context.Context, filter IFilter, obj T, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	return FindOneAndReplace[T](ctx, r.ms, filter, obj, fm)
+}
+
+// FindOneAndDelete rimuove e restituisce il documento, vedi FindOneAndDelete.
+func (r *Repository[T]) FindOneAndDelete(ctx context.Context, filter IFilter, fm FindAndModifyOptions) (*T, *core.ApplicationError) {
+	return FindOneAndDelete[T](ctx, r.ms, filter, fm)
+}
+
+// BulkWrite esegue le operazioni indicate, vedi BulkWrite.
+func (r *Repository[T]) BulkWrite(ctx context.Context, ops []BulkOperation, opts ...BulkOption) (*BulkResult, *core.ApplicationError) {
+	return BulkWrite(ctx, r.ms, ops, opts...)
+}
+
+// withFindOptions antepone le opzioni di default a quelle della chiamata.
+func (r *Repository[T]) withFindOptions(opts []options.Lister[options.FindOptions]) []options.Lister[options.FindOptions] {
+	if len(r.findOptions) == 0 {
+		return opts
+	}
+	all := make([]options.Lister[options.FindOptions], 0, len(r.findOptions)+len(opts))
+	all = append(all, r.findOptions...)
+	return append(all, opts...)
+}
@@ -0,0 +1,111 @@
+package coremongo
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.uber.org/fx"
+)
+
+// testRepoDoc viene registrato solo da NewRepository.
+type testRepoDoc struct {
+	ID string `bson:"_id"`
+}
+
+func (testRepoDoc) GetCollectionName(ctx context.Context) string { return "test_repo" }
+func (testRepoDoc) SoftDelete()                                  {}
+
+// testRepoFxDoc viene registrato solo da ProvideRepository.
+type testRepoFxDoc struct {
+	ID string `bson:"_id"`
+}
+
+func (testRepoFxDoc) GetCollectionName(ctx context.Context) string { return "test_repo_fx" }
+func (testRepoFxDoc) SoftDelete()                                  {}
+
+func TestRepositoryCollectionName(t *testing.T) {
+	ctx := context.Background()
+	if got := NewRepository[testAuditDoc](nil).CollectionName(ctx); got != "test_audit" {
+		t.Errorf("collection errata: %s", got)
+	}
+	if got := NewRepository[*testAuditDoc](nil).CollectionName(ctx); got != "test_audit" {
+		t.Errorf("collection errata per un tipo puntatore: %s", got)
+	}
+}
+
+func TestRepositoryRegistration(t *testing.T) {
+	ctx := context.Background()
+	if err := checkRegistered[testRepoDoc](ctx); err == nil {
+		t.Fatal("documento registrato prima di NewRepository")
+	}
+	NewRepository[testRepoDoc](nil)
+	if err := checkRegistered[testRepoDoc](ctx); err != nil || !isSoftDelete("test_repo") {
+		t.Errorf("documento non registrato da NewRepository: %v", err)
+	}
+
+	// Il documento viene registrato all'avvio anche se nessuno riceve il Repository
+	app := fx.New(
+		fx.NopLogger,
+		fx.Provide(func() *mongolks.LinkedService { return nil }),
+		ProvideRepository[testRepoFxDoc](),
+	)
+	if err := app.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRegistered[testRepoFxDoc](ctx); err != nil || !isSoftDelete("test_repo_fx") {
+		t.Errorf("documento non registrato da ProvideRepository: %v", err)
+	}
+
+	var repo *Repository[testRepoFxDoc]
+	app = fx.New(
+		fx.NopLogger,
+		fx.Provide(func() *mongolks.LinkedService { return nil }),
+		ProvideRepository[testRepoFxDoc](),
+		fx.Populate(&repo),
+	)
+	if err := app.Err(); err != nil || repo == nil {
+		t.Errorf("Repository non fornito: %v", err)
+	}
+}
+
+func TestRepositoryFindOptions(t *testing.T) {
+	repo := NewRepository[testBulkDoc](nil)
+	call := []options.Lister[options.FindOptions]{options.Find().SetLimit(5)}
+	if got := repo.withFindOptions(call); !reflect.DeepEqual(got, call) {
+		t.Errorf("senza opzioni di default vanno usate quelle della chiamata: %v", got)
+	}
+
+	def := options.Find().SetLimit(10)
+	repo = NewRepository[testBulkDoc](nil, WithDefaultFindOptions(def))
+	got := repo.withFindOptions(call)
+	if len(got) != 2 || got[0] != def || got[1] != call[0] {
+		t.Errorf("le opzioni di default vanno anteposte a quelle della chiamata: %v", got)
+	}
+	if len(repo.withFindOptions(nil)) != 1 {
+		t.Errorf("attese le sole opzioni di default")
+	}
+}
+
+func TestRepositoryDocumentPolicy(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository[testHookDoc](nil)
+	// Il filtro punta a un'altra collection: valgono comunque gli hook di T
+	other := NewQuery("altra", Raw(bson.M{"_id": "1"}))
+
+	if err := repo.Update(ctx, other, NewUpdate().Set("fiscale", "X")); err == nil || err.Code != "HOOK-IMMUTABILE" {
+		t.Errorf("atteso l'errore di BeforeUpdate, ottenuto %v", err)
+	}
+	if _, err := repo.UpdateManyExpect(ctx, other, NewUpdate().Set("fiscale", "X"), ExpectAny()); err == nil || err.Code != "HOOK-IMMUTABILE" {
+		t.Errorf("atteso l'errore di BeforeUpdate, ottenuto %v", err)
+	}
+	if err := repo.Delete(ctx, NewQuery("altra")); err == nil || err.Code != "MON-HOOK" {
+		t.Errorf("atteso l'errore di BeforeDelete, ottenuto %v", err)
+	}
+	if err := repo.DeleteMany(ctx, NewQuery("altra")); err == nil || err.Code != "MON-HOOK" {
+		t.Errorf("atteso l'errore di BeforeDelete, ottenuto %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package coremongo
+
+import (
+	"context"
+	"maps"
+	"time"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	// DeletedAtField è il campo con la data di cancellazione logica.
+	DeletedAtField = "deletedAt"
+	// DeletedByField è il campo con l'utente che ha cancellato il documento.
+	DeletedByField = "deletedBy"
+)
+
+// ISoftDelete è implementato dai documenti con cancellazione logica: DeleteOne e DeleteMany
+// valorizzano deletedAt e deletedBy invece di rimuovere il documento, e le letture escludono
+// i documenti cancellati. La collection va registrata all'avvio con RegisterSoftDelete o
+// RegisterDocument (lo fanno anche NewRepository e ProvideRepository).
+//
+//	type Cliente struct {
+//		...
+//		DeletedAt *time.Time `bson:"deletedAt,omitempty"`
+//		DeletedBy string     `bson:"deletedBy,omitempty"`
+//	}
+//
+//	func (Cliente) SoftDelete() {}
+type ISoftDelete interface {
+	ICollection
+	SoftDelete()
+}
+
+// RegisterSoftDelete registra la collection del documento T con cancellazione logica, vedi RegisterDocument.
+func RegisterSoftDelete[T ISoftDelete](ctx context.Context) {
+	RegisterDocument[T](ctx)
+}
+
+func isSoftDelete(collection string) bool {
+	return policyOfCollection(collection).softDelete
+}
+
+// withDeletedFilter è un filtro che comprende anche i documenti cancellati.
+type withDeletedFilter struct {
+	filter IFilter
+}
+
+// WithDeleted restituisce il filtro indicato senza l'esclusione dei documenti cancellati.
+//
+//	tutti, err := coremongo.GetObjectsByFilter[Cliente](ctx, ms, coremongo.WithDeleted(filtro))
+func WithDeleted(filter IFilter) IFilter {
+	return &withDeletedFilter{filter: filter}
+}
+
+func (f *withDeletedFilter) GetFilterCollectionName(ctx context.Context) string {
+	return f.filter.GetFilterCollectionName(ctx)
+}
+
+func (f *withDeletedFilter) Bson() (bson.M, error) {
+	return buildFilterBson(f.filter)
+}
+
+func (f *withDeletedFilter) unwrap() IFilter {
+	return f.filter
+}
+
+// includesDeleted indica se il filtro è stato esteso ai documenti cancellati con WithDeleted.
+func includesDeleted(filter IFilter) bool {
+	for filter != nil {
+		if _, ok := filter.(*withDeletedFilter); ok {
+			return true
+		}
+		w, ok := filter.(wrappedFilter)
+		if !ok {
+			return false
+		}
+		filter = w.unwrap()
+	}
+	return false
+}
+
+// excludeDeleted aggiunge al filtro l'esclusione dei documenti cancellati, se la collection ha la
+// cancellazione logica e il filtro non usa WithDeleted. Un filtro che già condiziona deletedAt
+// viene lasciato invariato.
+func excludeDeleted(collection string, filter IFilter, filterB bson.M) bson.M {
+	if !isSoftDelete(collection) || includesDeleted(filter) {
+		return filterB
+	}
+	return notDeleted(filterB)
+}
+
+// notDeleted restituisce il filtro ristretto ai documenti non cancellati. Un filtro che già
+// condiziona deletedAt viene lasciato invariato.
+func notDeleted(filterB bson.M) bson.M {
+	if _, ok := filterB[DeletedAtField]; ok {
+		return filterB
+	}
+	m := maps.Clone(filterB)
+	if m == nil {
+		m = bson.M{}
+	}
+	m[DeletedAtField] = nil
+	return m
+}
+
+// softDeleteUpdate è l'update della cancellazione logica.
+func softDeleteUpdate(ctx context.Context) bson.M {
+	return bson.M{"$set": bson.M{DeletedAtField: time.Now().UTC(), DeletedByField: principal(ctx)}}
+}
+
+// softDelete cancella logicamente il documento (o i documenti, con many) della collection che
+// soddisfano il filtro. Un documento già cancellato non viene contato; nello storico la cancellazione
+// è registrata come softDelete, con i campi di cancellazione aggiunti.
+func softDelete(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter, many bool, expect Expectation) (*WriteResult, *core.ApplicationError) {
+	filterB, errB := buildFilter(filter)
+	if errB != nil {
+		return nil, core.TechnicalErrorWithError(errB)
+	}
+	filterB = notDeleted(filterB)
+
+	coll := ms.GetCollection(collection, "")
+	var res *mongo.UpdateResult
+	err := writeWithHistory(ctx, coll, policy.history, HistorySoftDelete, filterB, filterCollation(filter), many, func(filterB bson.M) (any, error) {
+		var errW error
+		if many {
+			res, errW = coll.UpdateMany(ctx, filterB, softDeleteUpdate(ctx), options.UpdateMany().SetCollation(filterCollation(filter)))
+		} else {
+			res, errW = coll.UpdateOne(ctx, filterB, softDeleteUpdate(ctx), options.UpdateOne().SetCollation(filterCollation(filter)))
+		}
+		return nil, errW
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("Impossibile rimuovere %s %s", collection, err.Error())
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	result := &WriteResult{Deleted: res.MatchedCount}
+	return result, expect.check(*result, "rimozione")
+}
+
+// softDeleteModel restituisce il modello di BulkWrite della cancellazione logica.
+func softDeleteModel(ctx context.Context, collection string, filter IFilter, many bool) (string, mongo.WriteModel, error) {
+	filterB, err := buildFilter(filter)
+	if err != nil {
+		return "", nil, err
+	}
+	filterB = notDeleted(filterB)
+	if many {
+		return collection, mongo.NewUpdateManyModel().SetFilter(filterB).SetUpdate(softDeleteUpdate(ctx)).SetCollation(filterCollation(filter)), nil
+	}
+	return collection, mongo.NewUpdateOneModel().SetFilter(filterB).SetUpdate(softDeleteUpdate(ctx)).SetCollation(filterCollation(filter)), nil
+}
+
+// Restore ripristina i documenti cancellati logicamente che soddisfano il filtro, rimuovendo
+// deletedAt e deletedBy. Se nessun documento cancellato soddisfa il filtro restituisce NotFoundError.
+func Restore(ctx context.Context, ms *mongolks.LinkedService, filter IFilter) (*WriteResult, *core.ApplicationError) {
+	collection := filter.GetFilterCollectionName(ctx)
+	return restore(ctx, ms, collection, policyOfCollection(collection), filter)
+}
+
+func restore(ctx context.Context, ms *mongolks.LinkedService, collection string, policy *documentPolicy, filter IFilter) (*WriteResult, *core.ApplicationError) {
+	query := QueryFrom(WithDeleted(filter), Raw(bson.M{DeletedAtField: bson.M{"$ne": nil}}))
+	update := bson.M{"$unset": bson.M{DeletedAtField: "", DeletedByField: ""}}
+	return updateManyExpect(ctx, ms, collection, policy, query, update, ExpectAtLeastOneMatched())
+}
@@ -0,0 +1,150 @@
+package coremongo
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type testSoftDoc struct {
+	ID string `bson:"_id"`
+}
+
+func (testSoftDoc) GetCollectionName(ctx context.Context) string { return "test_soft" }
+func (testSoftDoc) SoftDelete()                                  {}
+
+// testSoftUnreadDoc non viene mai registrato.
+type testSoftUnreadDoc struct {
+	ID string `bson:"_id"`
+}
+
+func (testSoftUnreadDoc) GetCollectionName(ctx context.Context) string { return "test_soft_unread" }
+func (*testSoftUnreadDoc) SoftDelete()                                 {}
+
+type testSoftFilter struct {
+	Name string `field:"name" operator:"$eq" collation:"it" omitempty:"true"`
+}
+
+func (testSoftFilter) GetFilterCollectionName(ctx context.Context) string { return "test_soft" }
+
+func TestSoftDeleteRegistration(t *testing.T) {
+	RegisterDocument[testBulkDoc](context.Background())
+	if isSoftDelete("test") {
+		t.Errorf("collection senza ISoftDelete registrata")
+	}
+	RegisterSoftDelete[testSoftDoc](context.Background())
+	if !isSoftDelete("test_soft") {
+		t.Errorf("collection con ISoftDelete non registrata")
+	}
+	if err := checkRegistered[testSoftDoc](context.Background()); err != nil {
+		t.Errorf("documento registrato rifiutato: %v", err)
+	}
+	if err := checkRegistered[testBulkDoc](context.Background()); err != nil {
+		t.Errorf("documento senza comportamenti rifiutato: %v", err)
+	}
+}
+
+func TestExcludeDeleted(t *testing.T) {
+	RegisterSoftDelete[testSoftDoc](context.Background())
+	filter := &testSoftFilter{Name: "mario"}
+	filterB, err := buildFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := excludeDeleted("test_soft", filter, filterB)
+	if v, ok := got[DeletedAtField]; !ok || v != nil {
+		t.Errorf("esclusione dei cancellati assente: %v", got)
+	}
+	if _, ok := filterB[DeletedAtField]; ok {
+		t.Errorf("il filtro originale è stato modificato: %v", filterB)
+	}
+	if got := excludeDeleted("test", filter, filterB); len(got) != len(filterB) {
+		t.Errorf("esclusione su collection senza cancellazione logica: %v", got)
+	}
+
+	withDeleted := WithDeleted(filter)
+	filterW, err := buildFilter(withDeleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := excludeDeleted("test_soft", withDeleted, filterW); len(got) != 1 {
+		t.Errorf("WithDeleted non rispettato: %v", got)
+	}
+	query := QueryFrom(withDeleted, Where("age").Gt(18))
+	if !includesDeleted(query) {
+		t.Errorf("WithDeleted non rispettato dalla Query")
+	}
+	if filterCollation(query) == nil {
+		t.Errorf("collation persa attraverso WithDeleted")
+	}
+
+	explicit := bson.M{DeletedAtField: bson.M{"$ne": nil}}
+	if got := excludeDeleted("test_soft", nil, explicit); got[DeletedAtField] == nil {
+		t.Errorf("condizione esplicita su deletedAt sovrascritta: %v", got)
+	}
+}
+
+func TestSoftDeleteMatch(t *testing.T) {
+	RegisterSoftDelete[testSoftDoc](context.Background())
+	stage, appErr := match("$match", nil, &testSoftFilter{Name: "mario"})
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	m := stage[0].Value.(bson.M)
+	if v, ok := m[DeletedAtField]; !ok || v != nil {
+		t.Errorf("$match senza esclusione dei cancellati: %v", m)
+	}
+
+	stage, appErr = match("$match", nil, WithDeleted(&testSoftFilter{Name: "mario"}))
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	if _, ok := stage[0].Value.(bson.M)[DeletedAtField]; ok {
+		t.Errorf("$match con WithDeleted esclude i cancellati: %v", stage)
+	}
+}
+
+func TestSoftDeleteModel(t *testing.T) {
+	RegisterSoftDelete[testSoftDoc](context.Background())
+	withTestPrincipal(t, "mario")
+
+	_, model, err := BulkDeleteOne(WithDeleted(&testSoftFilter{Name: "mario"})).build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	update, ok := model.(*mongo.UpdateOneModel)
+	if !ok {
+		t.Fatalf("atteso UpdateOneModel, ottenuto %T", model)
+	}
+	if v, ok := update.Filter.(bson.M)[DeletedAtField]; !ok || v != nil {
+		t.Errorf("la cancellazione logica non esclude i documenti già cancellati: %v", update.Filter)
+	}
+	set := update.Update.(bson.M)["$set"].(bson.M)
+	if set[DeletedByField] != "mario" || set[DeletedAtField] == nil {
+		t.Errorf("update di cancellazione logica errato: %v", set)
+	}
+	if update.Collation == nil {
+		t.Errorf("collation del filtro persa")
+	}
+
+	_, model, err = BulkDeleteMany(NewQuery("test", Where("age").Gt(18))).build(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := model.(*mongo.DeleteManyModel); !ok {
+		t.Errorf("delete su collection senza cancellazione logica: %T", model)
+	}
+}
+
+func TestSoftDeleteNotRegistered(t *testing.T) {
+	err := checkRegistered[testSoftUnreadDoc](context.Background())
+	if err == nil || err.Code != "MON-REGISTER" {
+		t.Fatalf("atteso MON-REGISTER per un documento ISoftDelete non registrato, ottenuto %v", err)
+	}
+	if isSoftDelete("test_soft_unread") {
+		t.Errorf("collection non registrata con cancellazione logica")
+	}
+}
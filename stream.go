@@ -0,0 +1,121 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app/page"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// StreamObjectsByFilter è la variante in streaming di GetObjectsByFilter: i documenti vengono
+// decodificati uno alla volta mentre il cursore li legge a blocchi di batchSize (0 = default del driver).
+// Il cursore viene chiuso al termine, all'uscita anticipata dal range o alla cancellazione del contesto.
+// Un errore di decodifica riporta l'_id del documento e non interrompe l'iterazione.
+//
+//	for obj, err := range coremongo.StreamObjectsByFilter[Cliente](ctx, ms, filtro, 500) {
+//		if err != nil { ... }
+//	}
+func StreamObjectsByFilter[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, batchSize int32, opts ...options.Lister[options.FindOptions]) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		var obj T
+		collection := obj.GetCollectionName(ctx)
+		filterB, errB := buildFilter(filter)
+		if errB != nil {
+			yield(nil, errB)
+			return
+		}
+		if errR := checkRegistered[T](ctx); errR != nil {
+			yield(nil, errR)
+			return
+		}
+		filterB = excludeDeleted(collection, filter, filterB)
+		fo := filterFindOptions(filter, filterB, viewProjection[T]())
+		if batchSize > 0 {
+			fo = append(fo, options.Find().SetBatchSize(batchSize))
+		}
+		fo = append(fo, opts...)
+		cur, err := ms.GetCollection(collection, "").Find(ctx, filterB, fo...)
+		if err != nil {
+			yield(nil, fmt.Errorf("find %s: %w", collection, err))
+			return
+		}
+		streamCursor(ctx, cur, yield)
+	}
+}
+
+// StreamObjectsByFilterSorted è la variante in streaming di GetObjectsByFilterSorted.
+func StreamObjectsByFilterSorted[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, sort page.SortRequest, batchSize int32) iter.Seq2[*T, error] {
+	return StreamObjectsByFilter[T](ctx, ms, filter, batchSize, FindSortOption(sort))
+}
+
+// StreamAggregation è la variante in streaming di ExecuteAggregation.
+func StreamAggregation[T any](ctx context.Context, ls *mongolks.LinkedService, name string, params map[string]any, batchSize int32, opts ...options.Lister[options.AggregateOptions]) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		aggregation, ok := Aggregations[name]
+		if !ok {
+			yield(nil, fmt.Errorf("aggregation '%s' not found", name))
+			return
+		}
+		mp, errG := GenerateAggregation(aggregation, params)
+		if errG != nil {
+			yield(nil, fmt.Errorf("aggregation '%s': %s %s", name, errG.Code, errG.Message))
+			return
+		}
+		if zerolog.GlobalLevel() < zerolog.DebugLevel {
+			log.Trace().Str("pipeline", PipelineToJson(mp)).Msg("aggregation pipeline")
+		}
+		if batchSize > 0 {
+			opts = append([]options.Lister[options.AggregateOptions]{options.Aggregate().SetBatchSize(batchSize)}, opts...)
+		}
+		cur, err := ls.GetCollection(aggregation.Collection, "").Aggregate(ctx, mp, opts...)
+		if err != nil {
+			yield(nil, fmt.Errorf("aggregation '%s': %w", name, err))
+			return
+		}
+		streamCursor(ctx, cur, yield)
+	}
+}
+
+// closeCursor chiude il cursore dello streaming
+var closeCursor = (*mongo.Cursor).Close
+
+// streamCursor decodifica i documenti del cursore passandoli a yield e chiude il cursore all'uscita.
+func streamCursor[T any](ctx context.Context, cur *mongo.Cursor, yield func(*T, error) bool) {
+	defer func() {
+		// Il contesto potrebbe essere già cancellato: la chiusura deve comunque raggiungere il server
+		if errClose := closeCursor(cur, context.WithoutCancel(ctx)); errClose != nil {
+			log.Error().Err(errClose).Msg("close cursor error")
+		}
+	}()
+	for cur.Next(ctx) {
+		var obj T
+		if err := cur.Decode(&obj); err != nil {
+			id := "<assente>"
+			if rv, errId := cur.Current.LookupErr("_id"); errId == nil {
+				id = rv.String()
+			}
+			if !yield(nil, fmt.Errorf("decodifica documento _id=%s: %w", id, err)) {
+				return
+			}
+			continue
+		}
+		if errH := afterFind(ctx, &obj); errH != nil {
+			if !yield(nil, errH) {
+				return
+			}
+			continue
+		}
+		if !yield(&obj, nil) {
+			return
+		}
+	}
+	if err := cur.Err(); err != nil {
+		yield(nil, fmt.Errorf("cursor: %w", err))
+	}
+}
@@ -0,0 +1,118 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type testStreamDoc struct {
+	ID string `bson:"_id"`
+	N  int    `bson:"n"`
+}
+
+// withTestCursor restituisce un cursore sui documenti indicati e il contatore delle sue chiusure.
+func withTestCursor(t *testing.T, docs []any, preloaded error) (*mongo.Cursor, *int) {
+	t.Helper()
+	cur, err := mongo.NewCursorFromDocuments(docs, preloaded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := 0
+	previous := closeCursor
+	closeCursor = func(c *mongo.Cursor, ctx context.Context) error {
+		if c == cur {
+			closed++
+		}
+		return previous(c, ctx)
+	}
+	t.Cleanup(func() { closeCursor = previous })
+	return cur, &closed
+}
+
+// collectStream legge lo stream fino a limit documenti, poi esce dal range.
+func collectStream(cur *mongo.Cursor, limit int) ([]*testStreamDoc, []error) {
+	seq := func(yield func(*testStreamDoc, error) bool) {
+		streamCursor(context.Background(), cur, yield)
+	}
+	docs := make([]*testStreamDoc, 0)
+	errs := make([]error, 0)
+	for obj, err := range seq {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		docs = append(docs, obj)
+		if len(docs) == limit {
+			break
+		}
+	}
+	return docs, errs
+}
+
+func TestStreamCursorBreak(t *testing.T) {
+	cur, closed := withTestCursor(t, []any{
+		bson.D{{Key: "_id", Value: "1"}, {Key: "n", Value: 1}},
+		bson.D{{Key: "_id", Value: "2"}, {Key: "n", Value: 2}},
+		bson.D{{Key: "_id", Value: "3"}, {Key: "n", Value: 3}},
+	}, nil)
+
+	docs, errs := collectStream(cur, 2)
+	if len(docs) != 2 || len(errs) != 0 || docs[1].ID != "2" {
+		t.Errorf("documenti errati: %+v %v", docs, errs)
+	}
+	if *closed != 1 {
+		t.Errorf("cursore chiuso %d volte all'uscita anticipata", *closed)
+	}
+}
+
+func TestStreamCursorErrors(t *testing.T) {
+	cur, closed := withTestCursor(t, []any{
+		bson.D{{Key: "_id", Value: "1"}, {Key: "n", Value: 1}},
+		bson.D{{Key: "_id", Value: "2"}, {Key: "n", Value: "due"}},
+		bson.D{{Key: "_id", Value: "3"}, {Key: "n", Value: 3}},
+	}, nil)
+
+	docs, errs := collectStream(cur, 0)
+	if len(docs) != 2 || docs[1].ID != "3" {
+		t.Errorf("la decodifica fallita deve proseguire con i documenti successivi: %+v", docs)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `_id="2"`) {
+		t.Errorf("atteso l'errore di decodifica con l'_id, ottenuti %v", errs)
+	}
+	if *closed != 1 {
+		t.Errorf("cursore chiuso %d volte al termine", *closed)
+	}
+
+	cur, closed = withTestCursor(t, []any{}, errors.New("connessione persa"))
+	docs, errs = collectStream(cur, 0)
+	if len(docs) != 0 || len(errs) != 1 || !strings.Contains(errs[0].Error(), "connessione persa") {
+		t.Errorf("errore del cursore non propagato: %+v %v", docs, errs)
+	}
+	if *closed != 1 {
+		t.Errorf("cursore chiuso %d volte dopo l'errore", *closed)
+	}
+}
+
+func TestStreamSetupErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, err := range StreamObjectsByFilter[testBulkDoc](ctx, nil, testBadFilter{X: "a"}, 0) {
+		if err == nil {
+			t.Errorf("atteso l'errore del filtro")
+		}
+	}
+	count := 0
+	for _, err := range StreamAggregation[testBulkDoc](ctx, nil, "inesistente", nil, 0) {
+		count++
+		if err == nil || !strings.Contains(err.Error(), "inesistente") {
+			t.Errorf("atteso l'errore di aggregation inesistente, ottenuto %v", err)
+		}
+	}
+	if count != 1 {
+		t.Errorf("attesa una sola iterazione, ottenute %d", count)
+	}
+}
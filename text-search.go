@@ -0,0 +1,109 @@
+package coremongo
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// TextScoreField è il campo in cui le find di collection.go restituiscono il punteggio
+// della ricerca full-text: il documento lo riceve se ha un campo con tag `bson:"score"`.
+const TextScoreField = "score"
+
+// TextSearch è il valore dell'operatore $text del filter builder. Il campo non richiede il tag `field`:
+//
+//	Testo coremongo.TextSearch `operator:"$text"`
+//
+// Una ricerca con Search vuoto non produce alcuna condizione. È ammesso anche un campo string,
+// equivalente a TextSearch con il solo Search valorizzato.
+type TextSearch struct {
+	Search             string `json:"search,omitempty" yaml:"search,omitempty"`
+	Language           string `json:"language,omitempty" yaml:"language,omitempty"`
+	CaseSensitive      bool   `json:"caseSensitive,omitempty" yaml:"caseSensitive,omitempty"`
+	DiacriticSensitive bool   `json:"diacriticSensitive,omitempty" yaml:"diacriticSensitive,omitempty"`
+}
+
+// textScoreMeta è l'espressione del punteggio della ricerca full-text.
+var textScoreMeta = bson.M{"$meta": "textScore"}
+
+// handleTextOperator costruisce la clausola di primo livello $text.
+func handleTextOperator(operator string, fieldValue interface{}) (bson.M, error) {
+	var search TextSearch
+	switch v := fieldValue.(type) {
+	case TextSearch:
+		search = v
+	case string:
+		search = TextSearch{Search: v}
+	default:
+		return nil, fmt.Errorf("operatore '%s' richiede un valore di tipo TextSearch o stringa", operator)
+	}
+	if search.Search == "" {
+		return bson.M{}, nil
+	}
+
+	text := bson.M{"$search": search.Search}
+	if search.Language != "" {
+		text["$language"] = search.Language
+	}
+	if search.CaseSensitive {
+		text["$caseSensitive"] = true
+	}
+	if search.DiacriticSensitive {
+		text["$diacriticSensitive"] = true
+	}
+	return bson.M{operator: text}, nil
+}
+
+// hasTextSearch indica se il filtro costruito contiene una ricerca full-text, anche dentro
+// un gruppo logico (es. l'$and con cui QueryFrom estende la struct taggata).
+func hasTextSearch(filter bson.M) bool {
+	for key, value := range filter {
+		if clauseHasTextSearch(key, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func clauseHasTextSearch(key string, value any) bool {
+	if key == "$text" {
+		return true
+	}
+	members, ok := value.(bson.A)
+	if !logicalOperators[key] || !ok {
+		return false
+	}
+	for _, member := range members {
+		switch m := member.(type) {
+		case bson.M:
+			if hasTextSearch(m) {
+				return true
+			}
+		case bson.D:
+			for _, e := range m {
+				if clauseHasTextSearch(e.Key, e.Value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// textSearchFindOptions aggiunge il punteggio alla proiezione (nil = tutti i campi) e ordina per
+// punteggio decrescente. Va passata prima delle opzioni del chiamante, così che un ordinamento
+// esplicito abbia la precedenza.
+func textSearchFindOptions(projection Projection) options.Lister[options.FindOptions] {
+	return options.Find().
+		SetProjection(projection.withTextScore().bson()).
+		SetSort(bson.D{{Key: TextScoreField, Value: textScoreMeta}})
+}
+
+// textSearchFindOneOptions è l'equivalente di textSearchFindOptions per FindOne:
+// restituisce il documento con il punteggio più alto.
+func textSearchFindOneOptions(projection Projection) options.Lister[options.FindOneOptions] {
+	return options.FindOne().
+		SetProjection(projection.withTextScore().bson()).
+		SetSort(bson.D{{Key: TextScoreField, Value: textScoreMeta}})
+}
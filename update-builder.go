@@ -0,0 +1,322 @@
+package coremongo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// IUpdate è implementato dagli update costruiti a runtime (Update): UpdateOne, UpdateMany e le
+// operazioni di BulkWrite li accettano al posto di un bson.M.
+type IUpdate interface {
+	UpdateDocument() (any, error)
+}
+
+// updateOperators è l'ordine in cui gli operatori compaiono nel documento di update.
+var updateOperators = []string{"$set", "$unset", "$inc", "$min", "$max", "$currentDate", "$push", "$addToSet", "$pull"}
+
+// Update è un update costruito a runtime. Ogni campo può comparire una sola volta tra tutti gli
+// operatori: un conflitto (es. $set e $inc sullo stesso campo, o su "a" e "a.b") è un errore.
+//
+//	coremongo.NewUpdate().Set("status", "A").Inc("retries", 1).CurrentDate("updatedAt")
+type Update struct {
+	ops      map[string]bson.D
+	paths    []string
+	fields   map[string]bool
+	typeName string
+	pipeline []bson.D
+	err      error
+}
+
+// NewUpdate restituisce un update vuoto.
+func NewUpdate() *Update {
+	return &Update{ops: map[string]bson.D{}}
+}
+
+// NewUpdateFor restituisce un update sul documento T: il primo elemento del percorso di ogni campo
+// deve essere uno dei campi di T secondo i tag bson, così che un nome errato sia segnalato prima
+// di eseguire l'update. Un documento con una mappa inline ammette qualsiasi campo.
+func NewUpdateFor[T any]() *Update {
+	u := NewUpdate()
+	p, err := ProjectionOf[T]()
+	if err != nil {
+		u.err = err
+		return u
+	}
+	if p != nil {
+		u.typeName = reflect.TypeFor[T]().String()
+		u.fields = make(map[string]bool, len(p))
+		for _, e := range p {
+			u.fields[e.Key] = true
+		}
+	}
+	return u
+}
+
+// PipelineUpdate restituisce un update con pipeline di aggregazione ($set, $unset, $replaceWith, ...),
+// che può usare i valori degli altri campi del documento.
+//
+//	coremongo.PipelineUpdate(bson.D{{Key: "$set", Value: bson.M{"total": bson.M{"$add": bson.A{"$a", "$b"}}}}})
+func PipelineUpdate(stages ...bson.D) *Update {
+	u := NewUpdate()
+	if len(stages) == 0 {
+		u.err = errors.New("pipeline di update vuota")
+	}
+	u.pipeline = stages
+	return u
+}
+
+// Set imposta il valore del campo.
+func (u *Update) Set(field string, value any) *Update {
+	return u.add("$set", field, value)
+}
+
+// Unset rimuove i campi.
+func (u *Update) Unset(fields ...string) *Update {
+	for _, f := range fields {
+		u.add("$unset", f, "")
+	}
+	return u
+}
+
+// Inc incrementa il campo del valore indicato (negativo per decrementare).
+func (u *Update) Inc(field string, by any) *Update {
+	return u.add("$inc", field, by)
+}
+
+// Min imposta il campo al valore indicato se minore di quello attuale.
+func (u *Update) Min(field string, value any) *Update {
+	return u.add("$min", field, value)
+}
+
+// Max imposta il campo al valore indicato se maggiore di quello attuale.
+func (u *Update) Max(field string, value any) *Update {
+	return u.add("$max", field, value)
+}
+
+// CurrentDate imposta i campi alla data corrente del server.
+func (u *Update) CurrentDate(fields ...string) *Update {
+	for _, f := range fields {
+		u.add("$currentDate", f, true)
+	}
+	return u
+}
+
+// Push aggiunge il valore all'array.
+func (u *Update) Push(field string, value any) *Update {
+	return u.add("$push", field, value)
+}
+
+// PushModifier modifica un $push con $each: PushSlice, PushSort, PushPosition.
+type PushModifier func(bson.D) bson.D
+
+// PushSlice limita l'array ai primi n elementi (agli ultimi se negativo) dopo l'aggiunta.
+func PushSlice(n int) PushModifier {
+	return func(d bson.D) bson.D { return append(d, bson.E{Key: "$slice", Value: n}) }
+}
+
+// PushSort ordina l'array dopo l'aggiunta: 1/-1 per valori semplici, bson.D per sotto-documenti.
+func PushSort(sort any) PushModifier {
+	return func(d bson.D) bson.D { return append(d, bson.E{Key: "$sort", Value: sort}) }
+}
+
+// PushPosition inserisce i valori alla posizione indicata invece che in coda.
+func PushPosition(position int) PushModifier {
+	return func(d bson.D) bson.D { return append(d, bson.E{Key: "$position", Value: position}) }
+}
+
+// PushEach aggiunge all'array tutti gli elementi di values (slice o array).
+//
+//	u.PushEach("lastEvents", events, coremongo.PushSort(bson.D{{Key: "at", Value: -1}}), coremongo.PushSlice(10))
+func (u *Update) PushEach(field string, values any, mods ...PushModifier) *Update {
+	if !isSliceValue(values) {
+		return u.fail(fmt.Errorf("$push $each sul campo '%s' richiede uno slice", field))
+	}
+	each := bson.D{{Key: "$each", Value: values}}
+	for _, m := range mods {
+		each = m(each)
+	}
+	return u.add("$push", field, each)
+}
+
+// AddToSet aggiunge il valore all'array se non già presente.
+func (u *Update) AddToSet(field string, value any) *Update {
+	return u.add("$addToSet", field, value)
+}
+
+// AddToSetEach aggiunge all'array gli elementi di values (slice o array) non già presenti.
+func (u *Update) AddToSetEach(field string, values any) *Update {
+	if !isSliceValue(values) {
+		return u.fail(fmt.Errorf("$addToSet $each sul campo '%s' richiede uno slice", field))
+	}
+	return u.add("$addToSet", field, bson.D{{Key: "$each", Value: values}})
+}
+
+// Pull rimuove dall'array gli elementi uguali al valore o che soddisfano la condizione
+// (es. bson.M{"$lt": 5}, o una Condition per array di sotto-documenti).
+func (u *Update) Pull(field string, condition any) *Update {
+	if c, ok := condition.(Condition); ok {
+		m, err := c.M()
+		if err != nil {
+			return u.fail(err)
+		}
+		condition = m
+	}
+	return u.add("$pull", field, condition)
+}
+
+// SetFields aggiunge un $set per ogni campo non zero della struct (o puntatore a struct), secondo
+// i tag bson: è il comportamento atteso da una PATCH. Un puntatore non nil viene sempre impostato,
+// anche se punta a un valore zero; le struct annidate vengono impostate campo per campo
+// ("address.city") per non sovrascrivere gli altri sotto-campi. _id non viene mai impostato.
+func (u *Update) SetFields(partial any) *Update {
+	v := reflect.ValueOf(partial)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return u
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return u.fail(fmt.Errorf("SetFields richiede una struct, ricevuto %T", partial))
+	}
+	u.setStructFields(v, "")
+	return u
+}
+
+var (
+	bsonMarshalerType      = reflect.TypeFor[bson.Marshaler]()
+	bsonValueMarshalerType = reflect.TypeFor[bson.ValueMarshaler]()
+)
+
+func (u *Update) setStructFields(v reflect.Value, prefix string) {
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, inline := bsonFieldName(field)
+		if name == "-" || (prefix == "" && name == "_id") {
+			continue
+		}
+
+		fv := v.Field(i)
+		explicit := false
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+			explicit = true
+		}
+		if isPatchStruct(fv.Type()) {
+			if inline {
+				u.setStructFields(fv, prefix)
+			} else {
+				u.setStructFields(fv, prefix+name+".")
+			}
+			continue
+		}
+		if !explicit && fv.IsZero() {
+			continue
+		}
+		u.add("$set", prefix+name, fv.Interface())
+	}
+}
+
+// isPatchStruct indica se la struct va impostata campo per campo: sono esclusi time.Time
+// e i tipi con una propria codifica bson.
+func isPatchStruct(typ reflect.Type) bool {
+	if typ.Kind() != reflect.Struct || typ == reflect.TypeFor[time.Time]() {
+		return false
+	}
+	ptr := reflect.PointerTo(typ)
+	for _, t := range []reflect.Type{typ, ptr} {
+		if t.Implements(bsonMarshalerType) || t.Implements(bsonValueMarshalerType) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdateDocument restituisce il documento di update (bson.M) o la pipeline (bson.A).
+func (u *Update) UpdateDocument() (any, error) {
+	if u == nil {
+		return nil, errors.New("update nil")
+	}
+	if u.err != nil {
+		return nil, u.err
+	}
+	if u.pipeline != nil {
+		if len(u.ops) > 0 {
+			return nil, errors.New("un update con pipeline non può avere anche operatori")
+		}
+		pipeline := make(bson.A, 0, len(u.pipeline))
+		for _, s := range u.pipeline {
+			pipeline = append(pipeline, s)
+		}
+		return pipeline, nil
+	}
+	if len(u.ops) == 0 {
+		return nil, errors.New("update vuoto")
+	}
+	doc := bson.M{}
+	for _, op := range updateOperators {
+		if fields, ok := u.ops[op]; ok {
+			doc[op] = fields
+		}
+	}
+	return doc, nil
+}
+
+func (u *Update) add(operator, field string, value any) *Update {
+	if u.err != nil {
+		return u
+	}
+	if field == "" {
+		return u.fail(fmt.Errorf("campo vuoto per l'operatore '%s'", operator))
+	}
+	if u.fields != nil {
+		root, _, _ := strings.Cut(field, ".")
+		if !u.fields[root] {
+			return u.fail(fmt.Errorf("campo '%s' non presente in %s", field, u.typeName))
+		}
+	}
+	for _, p := range u.paths {
+		if p == field || strings.HasPrefix(field, p+".") || strings.HasPrefix(p, field+".") {
+			return u.fail(fmt.Errorf("campo '%s' in conflitto con '%s' già aggiornato", field, p))
+		}
+	}
+	u.paths = append(u.paths, field)
+	u.ops[operator] = append(u.ops[operator], bson.E{Key: field, Value: value})
+	return u
+}
+
+func (u *Update) fail(err error) *Update {
+	if u.err == nil {
+		u.err = err
+	}
+	return u
+}
+
+func isSliceValue(values any) bool {
+	kind := reflect.ValueOf(values).Kind()
+	return kind == reflect.Slice || kind == reflect.Array
+}
+
+// updateDocument restituisce il documento di update: un IUpdate viene costruito, un bson.M
+// o una pipeline vengono passati così come sono.
+func updateDocument(update any) (any, error) {
+	if u, ok := update.(IUpdate); ok {
+		return u.UpdateDocument()
+	}
+	if update == nil {
+		return nil, errors.New("update nil")
+	}
+	return update, nil
+}
@@ -0,0 +1,94 @@
+package coremongo
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testPatchAddress struct {
+	City string `bson:"city"`
+	Zip  string `bson:"zip"`
+}
+
+type testCustomerPatch struct {
+	ID       string           `bson:"_id"`
+	Name     string           `bson:"name"`
+	Age      *int             `bson:"age"`
+	Address  testPatchAddress `bson:"address"`
+	Birth    time.Time        `bson:"birth"`
+	Tags     []string         `bson:"tags"`
+	Internal string           `bson:"-"`
+}
+
+func assertUpdateJSON(t *testing.T, u *Update, want string) {
+	t.Helper()
+	doc, err := u.UpdateDocument()
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	m, ok := doc.(bson.M)
+	if !ok {
+		t.Fatalf("atteso bson.M, ottenuto %T", doc)
+	}
+	assertFilterJSON(t, m, want)
+}
+
+func TestUpdateBuilder(t *testing.T) {
+	u := NewUpdate().
+		Set("status", "A").
+		Unset("tmp").
+		Inc("retries", 1).
+		Max("score", 10).
+		CurrentDate("updatedAt").
+		PushEach("events", []string{"a", "b"}, PushSort(-1), PushSlice(5)).
+		AddToSetEach("tags", []string{"x"}).
+		Pull("items", Where("qty").Lt(1))
+	assertUpdateJSON(t, u, `{
+		"$set": {"status": "A"},
+		"$unset": {"tmp": ""},
+		"$inc": {"retries": 1},
+		"$max": {"score": 10},
+		"$currentDate": {"updatedAt": true},
+		"$push": {"events": {"$each": ["a", "b"], "$sort": -1, "$slice": 5}},
+		"$addToSet": {"tags": {"$each": ["x"]}},
+		"$pull": {"items": {"qty": {"$lt": 1}}}
+	}`)
+}
+
+func TestUpdateBuilderErrors(t *testing.T) {
+	cases := map[string]*Update{
+		"vuoto":                NewUpdate(),
+		"conflitto":            NewUpdate().Set("a", 1).Inc("a", 1),
+		"conflitto annidato":   NewUpdate().Set("a", bson.M{}).Set("a.b", 1),
+		"each non slice":       NewUpdate().PushEach("a", 1),
+		"campo inesistente":    NewUpdateFor[testCustomerPatch]().Set("nmae", "x"),
+		"pipeline e operatori": PipelineUpdate(bson.D{{Key: "$set", Value: bson.M{"a": 1}}}).Set("b", 1),
+	}
+	for name, u := range cases {
+		if _, err := u.UpdateDocument(); err == nil {
+			t.Errorf("%s: atteso errore", name)
+		}
+	}
+
+	if _, err := NewUpdateFor[testCustomerPatch]().Set("address.city", "Roma").UpdateDocument(); err != nil {
+		t.Errorf("percorso valido: %v", err)
+	}
+}
+
+func TestUpdateSetFields(t *testing.T) {
+	zero := 0
+	patch := testCustomerPatch{ID: "1", Name: "Mario", Age: &zero, Address: testPatchAddress{City: "Roma"}, Internal: "x"}
+	assertUpdateJSON(t, NewUpdate().SetFields(&patch), `{"$set": {"name": "Mario", "age": 0, "address.city": "Roma"}}`)
+}
+
+func TestPipelineUpdate(t *testing.T) {
+	doc, err := PipelineUpdate(bson.D{{Key: "$set", Value: bson.M{"total": bson.M{"$add": bson.A{"$a", "$b"}}}}}).UpdateDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pipeline, ok := doc.(bson.A); !ok || len(pipeline) != 1 {
+		t.Fatalf("attesa una pipeline di uno stage, ottenuto %v", doc)
+	}
+}
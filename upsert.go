@@ -0,0 +1,247 @@
+package coremongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// UpsertResult è l'esito dell'upsert di un documento.
+type UpsertResult struct {
+	// Inserted indica se il documento è stato inserito invece che aggiornato.
+	Inserted bool
+	// UpsertedID è l'_id del documento inserito.
+	UpsertedID any
+	// Err è l'errore del singolo documento in UpsertMany.
+	Err error
+}
+
+// upsertPlan sono i campi del documento che formano la chiave naturale e quelli da scrivere
+// solo all'inserimento.
+type upsertPlan struct {
+	keys     []string
+	onInsert map[string]bool
+}
+
+// upsertPlans contiene i piani già calcolati per tipo
+var upsertPlans sync.Map
+
+func getUpsertPlan(typ reflect.Type) (*upsertPlan, error) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if cached, ok := upsertPlans.Load(typ); ok {
+		return cached.(*upsertPlan), nil
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("l'upsert richiede una struct, ricevuto %s", typ)
+	}
+	plan := &upsertPlan{onInsert: map[string]bool{}}
+	collectUpsertFields(plan, typ)
+	if len(plan.keys) == 0 {
+		return nil, fmt.Errorf("nessun campo con tag upsertKey in %s", typ)
+	}
+	upsertPlans.Store(typ, plan)
+	return plan, nil
+}
+
+func collectUpsertFields(plan *upsertPlan, typ reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, inline := bsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		if inline {
+			ft := field.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectUpsertFields(plan, ft)
+			}
+			continue
+		}
+		if field.Tag.Get("upsertKey") == "true" {
+			plan.keys = append(plan.keys, name)
+		}
+		if field.Tag.Get("setOnInsert") == "true" {
+			plan.onInsert[name] = true
+		}
+	}
+}
+
+// upsertModel restituisce filtro e update dell'upsert del documento: il filtro è formato dai campi
+// chiave, i campi con tag setOnInsert (e _id, se valorizzato) vanno in $setOnInsert, gli altri in $set.
+func upsertModel(obj any) (bson.M, bson.M, error) {
+	plan, err := getUpsertPlan(reflect.TypeOf(obj))
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := bson.Marshal(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	elements, err := bson.Raw(raw).Elements()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filter := bson.M{}
+	set := bson.D{}
+	onInsert := bson.D{}
+	for _, el := range elements {
+		key, value := el.Key(), el.Value()
+		switch {
+		case slices.Contains(plan.keys, key):
+			filter[key] = value
+		case key == "_id":
+			if !isEmptyID(value) {
+				onInsert = append(onInsert, bson.E{Key: key, Value: value})
+			}
+		case plan.onInsert[key]:
+			onInsert = append(onInsert, bson.E{Key: key, Value: value})
+		default:
+			set = append(set, bson.E{Key: key, Value: value})
+		}
+	}
+	for _, k := range plan.keys {
+		if _, ok := filter[k]; !ok {
+			return nil, nil, fmt.Errorf("campo chiave '%s' assente nel documento", k)
+		}
+	}
+
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(onInsert) > 0 {
+		update["$setOnInsert"] = onInsert
+	}
+	if len(update) == 0 {
+		// Documento con i soli campi chiave: all'inserimento vengono presi dal filtro
+		update["$setOnInsert"] = filter
+	}
+	return filter, update, nil
+}
+
+// isEmptyID indica se l'_id non è valorizzato e va quindi generato dal server.
+func isEmptyID(value bson.RawValue) bool {
+	switch value.Type {
+	case bson.TypeNull, bson.TypeUndefined:
+		return true
+	case bson.TypeString:
+		return value.StringValue() == ""
+	case bson.TypeObjectID:
+		return value.ObjectID().IsZero()
+	}
+	return false
+}
+
+// Upsert inserisce il documento o aggiorna quello con la stessa chiave naturale, formata dai campi
+// con tag `upsertKey:"true"`. I campi con tag `setOnInsert:"true"` (es. createdAt) vengono scritti
+// solo all'inserimento. L'update dell'upsert viene controllato da IBeforeUpdate; IBeforeInsert e
+// IBeforeReplace non vengono chiamati.
+//
+//	type Movimento struct {
+//		ID        bson.ObjectID `bson:"_id,omitempty"`
+//		Conto     string        `bson:"conto" upsertKey:"true"`
+//		Numero    int           `bson:"numero" upsertKey:"true"`
+//		Importo   float64       `bson:"importo"`
+//		CreatedAt time.Time     `bson:"createdAt" setOnInsert:"true"`
+//	}
+func Upsert[T ICollection](ctx context.Context, ms *mongolks.LinkedService, obj T) (*UpsertResult, *core.ApplicationError) {
+	filter, update, err := upsertModel(obj)
+	if err != nil {
+		return nil, core.TechnicalErrorWithError(err)
+	}
+	if errR := checkRegistered[T](ctx); errR != nil {
+		return nil, errR
+	}
+	collection := obj.GetCollectionName(ctx)
+	res, errU := updateOneExpect(ctx, ms, collection, policyOf[T](), NewQuery(collection, Raw(filter)), update, ExpectMatched(1), options.UpdateOne().SetUpsert(true))
+	if errU != nil {
+		return nil, errU
+	}
+	return &UpsertResult{Inserted: res.Upserted > 0, UpsertedID: res.UpsertedID}, nil
+}
+
+// UpsertMany esegue l'upsert dei documenti con una BulkWrite e restituisce l'esito di ciascuno,
+// nello stesso ordine. Se qualche documento fallisce viene restituito anche l'errore MON-BULK. I
+// documenti IHistory vengono scritti uno alla volta con Upsert, che ne registra lo storico: delle
+// opzioni vale solo BulkOrdered.
+func UpsertMany[T ICollection](ctx context.Context, ms *mongolks.LinkedService, objs []T, opts ...BulkOption) ([]UpsertResult, *core.ApplicationError) {
+	if policyOf[T]().history {
+		return upsertEach(ctx, ms, objs, newBulkConfig(opts).ordered)
+	}
+	ops := make([]BulkOperation, 0, len(objs))
+	for _, obj := range objs {
+		ops = append(ops, bulkUpsertByKey(obj))
+	}
+	res, err := BulkWrite(ctx, ms, ops, opts...)
+	if res == nil {
+		return nil, err
+	}
+	results := make([]UpsertResult, len(res.Items))
+	for i, item := range res.Items {
+		results[i] = UpsertResult{Inserted: item.UpsertedID != nil, UpsertedID: item.UpsertedID, Err: item.Err}
+	}
+	return results, err
+}
+
+// upsertEach esegue l'upsert dei documenti uno alla volta; con ordered i documenti dopo il primo
+// fallito non vengono scritti.
+func upsertEach[T ICollection](ctx context.Context, ms *mongolks.LinkedService, objs []T, ordered bool) ([]UpsertResult, *core.ApplicationError) {
+	results := make([]UpsertResult, len(objs))
+	failed := 0
+	for i, obj := range objs {
+		if ordered && failed > 0 {
+			results[i].Err = errBulkNotExecuted
+			continue
+		}
+		res, err := Upsert(ctx, ms, obj)
+		if err != nil {
+			results[i].Err = err
+			failed++
+			continue
+		}
+		results[i] = *res
+	}
+	if failed > 0 {
+		log.Error().Msgf("Upsert: %d documenti falliti su %d", failed, len(objs))
+		return results, core.TechnicalErrorWithCodeAndMessage("MON-BULK", fmt.Sprintf("%d operazioni fallite su %d", failed, len(objs)))
+	}
+	return results, nil
+}
+
+// bulkUpsertByKey restituisce l'upsert del documento secondo la chiave naturale, con i campi di
+// audit e la versione del documento come in Upsert.
+func bulkUpsertByKey[T ICollection](obj T) BulkOperation {
+	return BulkOperation{build: func(ctx context.Context) (string, mongo.WriteModel, error) {
+		filter, update, err := upsertModel(obj)
+		if err != nil {
+			return "", nil, err
+		}
+		if errR := checkRegistered[T](ctx); errR != nil {
+			return "", nil, errR
+		}
+		collection := obj.GetCollectionName(ctx)
+		doc, errU := bulkUpdateDocument(ctx, collection, policyOf[T](), nil, update)
+		if errU != nil {
+			return "", nil, errU
+		}
+		return collection, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(doc).SetUpsert(true), nil
+	}}
+}
@@ -0,0 +1,77 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type testMovement struct {
+	ID        bson.ObjectID `bson:"_id,omitempty"`
+	Account   string        `bson:"account" upsertKey:"true"`
+	Number    int           `bson:"number" upsertKey:"true"`
+	Amount    float64       `bson:"amount"`
+	CreatedAt time.Time     `bson:"createdAt" setOnInsert:"true"`
+}
+
+func (testMovement) GetCollectionName(ctx context.Context) string { return "movements" }
+
+func TestUpsertModel(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	filter, update, err := upsertModel(testMovement{Account: "IT01", Number: 7, Amount: 10.5, CreatedAt: created})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, filter, `{"account": "IT01", "number": 7}`)
+	assertFilterJSON(t, update, `{
+		"$set": {"amount": 10.5},
+		"$setOnInsert": {"createdAt": {"$date": "2024-01-02T03:04:05Z"}}
+	}`)
+
+	id := bson.NewObjectID()
+	_, update, err = upsertModel(testMovement{ID: id, Account: "IT01", Number: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	onInsert := update["$setOnInsert"].(bson.D)
+	if onInsert[0].Key != "_id" || onInsert[0].Value.(bson.RawValue).ObjectID() != id {
+		t.Errorf("atteso _id in $setOnInsert, ottenuto %v", onInsert)
+	}
+
+	if _, _, err := upsertModel(testBulkDoc{ID: "1"}); err == nil {
+		t.Error("atteso errore per un documento senza campi chiave")
+	}
+}
+
+type testHistoryMovement struct {
+	Account string `bson:"account" upsertKey:"true"`
+}
+
+func (testHistoryMovement) GetCollectionName(ctx context.Context) string { return "history_movements" }
+func (testHistoryMovement) History()                                     {}
+
+func TestUpsertManyHistory(t *testing.T) {
+	// Il documento non è registrato: ogni Upsert fallisce prima di scrivere
+	objs := []testHistoryMovement{{Account: "IT01"}, {Account: "IT02"}}
+	results, err := UpsertMany(context.Background(), nil, objs)
+	if err == nil || err.Code != "MON-BULK" || len(results) != 2 {
+		t.Fatalf("atteso MON-BULK, ottenuto %v %+v", err, results)
+	}
+	if !hasErrorCode(results[0].Err, "MON-REGISTER") || !errors.Is(results[1].Err, errBulkNotExecuted) {
+		t.Errorf("in esecuzione ordinata il secondo upsert non va eseguito: %+v", results)
+	}
+
+	results, _ = UpsertMany(context.Background(), nil, objs, BulkOrdered(false))
+	if !hasErrorCode(results[0].Err, "MON-REGISTER") || !hasErrorCode(results[1].Err, "MON-REGISTER") {
+		t.Errorf("in esecuzione non ordinata tutti gli upsert vanno tentati: %+v", results)
+	}
+}
+
+func hasErrorCode(err error, code string) bool {
+	var appErr *core.ApplicationError
+	return errors.As(err, &appErr) && appErr.Code == code
+}
@@ -0,0 +1,234 @@
+package coremongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/tpm-mongo-common/mongolks"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// VersionField è il campo con la versione del documento.
+const VersionField = "version"
+
+// DefaultVersionRetries sono i tentativi di ReplaceWithRetry se non indicati.
+const DefaultVersionRetries = 3
+
+// VersionFields è la versione gestita da coremongo, da includere inline nel documento.
+type VersionFields struct {
+	Version int64 `bson:"version" json:"version"`
+}
+
+// Versioning restituisce la versione: includendo VersionFields il documento implementa Versioned.
+func (v *VersionFields) Versioning() *VersionFields {
+	return v
+}
+
+// Versioned è implementato dai documenti con controllo di concorrenza ottimistico. ReplaceOne e
+// FindOneAndReplace scrivono il documento solo se la versione sul database è ancora quella letta e la incrementa;
+// se nel frattempo un'altra operazione lo ha modificato restituisce l'errore MON-CONFLICT
+// (vedi IsVersionConflict). UpdateOne, UpdateMany e FindOneAndUpdate incrementano la versione e,
+// con un filtro AtVersion, la verificano allo stesso modo: un filtro AtVersion incrementa la versione anche
+// su documenti che non implementano Versioned.
+//
+//	type Contratto struct {
+//		ID                      string `bson:"_id"`
+//		coremongo.VersionFields `bson:",inline"`
+//		...
+//	}
+//
+// I documenti vanno passati per puntatore per ricevere la versione scritta. Gli update, generici
+// sul documento, e i documenti passati per valore vengono riconosciuti dal tipo.
+type Versioned interface {
+	ICollection
+	Versioning() *VersionFields
+}
+
+// versionFilter è un filtro che richiede una versione del documento.
+type versionFilter struct {
+	filter  IFilter
+	version int64
+}
+
+// AtVersion restituisce il filtro indicato ristretto alla versione del documento letto: un update
+// che non trova il documento a quella versione restituisce l'errore MON-CONFLICT.
+//
+//	err := coremongo.UpdateOne(ctx, ms, coremongo.AtVersion(filtro, contratto.Version), update)
+func AtVersion(filter IFilter, version int64) IFilter {
+	return &versionFilter{filter: filter, version: version}
+}
+
+func (f *versionFilter) GetFilterCollectionName(ctx context.Context) string {
+	return f.filter.GetFilterCollectionName(ctx)
+}
+
+func (f *versionFilter) Bson() (bson.M, error) {
+	filterB, err := buildFilterBson(f.filter)
+	if err != nil {
+		return nil, err
+	}
+	return withVersion(filterB, f.version), nil
+}
+
+func (f *versionFilter) unwrap() IFilter {
+	return f.filter
+}
+
+// hasVersion indica se il filtro richiede una versione con AtVersion.
+func hasVersion(filter IFilter) bool {
+	for filter != nil {
+		if _, ok := filter.(*versionFilter); ok {
+			return true
+		}
+		w, ok := filter.(wrappedFilter)
+		if !ok {
+			return false
+		}
+		filter = w.unwrap()
+	}
+	return false
+}
+
+// withVersion restituisce il filtro ristretto alla versione indicata. Un documento scritto prima di
+// diventare Versioned non ha il campo della versione: la versione 0 comprende il campo assente.
+func withVersion(filterB bson.M, version int64) bson.M {
+	m := maps.Clone(filterB)
+	if m == nil {
+		m = bson.M{}
+	}
+	if version != 0 {
+		m[VersionField] = version
+		return m
+	}
+	delete(m, VersionField)
+	appendLogicalGroup(m, &logicalGroup{operator: "$or", members: bson.A{
+		bson.M{VersionField: int64(0)},
+		bson.M{VersionField: bson.M{"$exists": false}},
+	}})
+	return m
+}
+
+// versionUpdate aggiunge all'update l'incremento della versione. La versione impostata dal
+// chiamante viene rimossa da tutti gli operatori ($set, $inc, $max, $unset, $currentDate, ...);
+// a una pipeline viene aggiunto uno stage $set equivalente.
+func versionUpdate(update any) (any, error) {
+	if pipeline, ok := updatePipeline(update); ok {
+		return append(pipeline, bson.D{{Key: "$set", Value: bson.D{{Key: VersionField, Value: bson.D{
+			{Key: "$add", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$" + VersionField, 0}}}, 1}},
+		}}}}}), nil
+	}
+
+	doc, err := bsonD(update)
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = withoutUpdatePaths(doc, VersionField); err != nil {
+		return nil, err
+	}
+	inc := bson.D{}
+	out := make(bson.D, 0, len(doc)+1)
+	for _, e := range doc {
+		if e.Key == "$inc" {
+			inc = e.Value.(bson.D)
+			continue
+		}
+		out = append(out, e)
+	}
+	return append(out, bson.E{Key: "$inc", Value: append(inc, bson.E{Key: VersionField, Value: 1})}), nil
+}
+
+// versionedOf restituisce il documento Versioned da scrivere: quello ricevuto se è un puntatore,
+// altrimenti una sua copia per puntatore.
+func versionedOf(obj ICollection) (Versioned, bool) {
+	if isNilPointer(obj) || !policyOfType(reflect.TypeOf(obj)).versioned {
+		return nil, false
+	}
+	if v, ok := obj.(Versioned); ok && reflect.TypeOf(obj).Kind() == reflect.Pointer {
+		return v, true
+	}
+	ptr := reflect.New(reflect.TypeOf(obj))
+	ptr.Elem().Set(reflect.ValueOf(obj))
+	return ptr.Interface().(Versioned), true
+}
+
+// isVersionConflictWrite indica se l'errore di una scrittura a una versione è un conflitto: un upsert
+// che non trova il documento alla versione richiesta tenta di inserirlo con lo stesso _id.
+func isVersionConflictWrite(err error) bool {
+	return mongo.IsDuplicateKeyError(err)
+}
+
+// versionConflictError è l'errore di un documento modificato da un'altra operazione.
+func versionConflictError(collection string) *core.ApplicationError {
+	message := fmt.Sprintf("documento di %s modificato da un'altra operazione o inesistente", collection)
+	log.Warn().Msg(message)
+	return core.BusinessErrorWithCodeAndMessage("MON-CONFLICT", message)
+}
+
+// IsVersionConflict indica se l'errore è un conflitto di versione (MON-CONFLICT).
+func IsVersionConflict(err *core.ApplicationError) bool {
+	return err != nil && err.Code == "MON-CONFLICT"
+}
+
+// ReplaceWithRetry legge il documento che soddisfa il filtro, lo modifica con mutate e lo sostituisce
+// controllando la versione. In caso di conflitto rilegge il documento e riprova, fino a attempts
+// tentativi (DefaultVersionRetries se <= 0). mutate deve poter essere rieseguita sul documento riletto;
+// un suo errore interrompe l'operazione ed è restituito come ApplicationError.
+//
+//	contratto, err := coremongo.ReplaceWithRetry[Contratto](ctx, ms, filtro, 0, func(c *Contratto) error {
+//		c.Stato = "FIRMATO"
+//		return nil
+//	})
+func ReplaceWithRetry[T ICollection](ctx context.Context, ms *mongolks.LinkedService, filter IFilter, attempts int, mutate func(obj *T) error) (*T, *core.ApplicationError) {
+	if attempts <= 0 {
+		attempts = DefaultVersionRetries
+	}
+	for attempt := 1; ; attempt++ {
+		obj, err := GetObjectByFilter[T](ctx, ms, filter)
+		if err != nil {
+			return nil, err
+		}
+		doc, ok := any(obj).(Versioned)
+		if !ok {
+			return nil, core.TechnicalErrorWithCodeAndMessage("MON-VERSION", fmt.Sprintf("%T non implementa Versioned", obj))
+		}
+		if errM := mutate(obj); errM != nil {
+			var appErr *core.ApplicationError
+			if errors.As(errM, &appErr) {
+				return nil, appErr
+			}
+			return nil, core.TechnicalErrorWithError(errM)
+		}
+		byID, errID := filterByID(ctx, doc)
+		if errID != nil {
+			return nil, core.TechnicalErrorWithError(errID)
+		}
+		_, err = ReplaceOneExpect(ctx, ms, byID, doc, ExpectMatched(1))
+		if err == nil {
+			return obj, nil
+		}
+		if !IsVersionConflict(err) || attempt >= attempts {
+			return nil, err
+		}
+		log.Debug().Msgf("conflitto di versione su %s, tentativo %d di %d", doc.GetCollectionName(ctx), attempt, attempts)
+	}
+}
+
+// filterByID restituisce il filtro per _id del documento.
+func filterByID(ctx context.Context, obj ICollection) (IFilter, error) {
+	doc, err := bsonD(obj)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return NewQuery(obj.GetCollectionName(ctx), Where("_id").Eq(e.Value)), nil
+		}
+	}
+	return nil, fmt.Errorf("_id assente nel documento di %s", obj.GetCollectionName(ctx))
+}
@@ -0,0 +1,146 @@
+package coremongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/GPA-Gruppo-Progetti-Avanzati-SRL/go-core-app"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+type testVersionDoc struct {
+	ID            string `bson:"_id"`
+	Name          string `bson:"name"`
+	VersionFields `bson:",inline"`
+}
+
+func (testVersionDoc) GetCollectionName(ctx context.Context) string { return "test_version" }
+
+func TestAtVersion(t *testing.T) {
+	filter := QueryFrom(AtVersion(&testCollationFilter{Name: "mario"}, 3), Where("age").Gt(18))
+	if !hasVersion(filter) {
+		t.Errorf("AtVersion non riconosciuto attraverso la Query")
+	}
+	if hasVersion(&testCollationFilter{Name: "mario"}) {
+		t.Errorf("versione riconosciuta su un filtro senza AtVersion")
+	}
+	if filterCollation(filter) == nil {
+		t.Errorf("collation persa attraverso AtVersion")
+	}
+	filterB, err := buildFilter(AtVersion(&testCollationFilter{Name: "mario"}, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filterB[VersionField] != int64(3) || filterB["name"] == nil {
+		t.Errorf("filtro AtVersion errato: %v", filterB)
+	}
+
+	// La versione 0 comprende i documenti scritti prima di diventare Versioned
+	filterB, err = buildFilter(AtVersion(NewQuery("test_version", Where("_id").Eq("1")), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFilterJSON(t, filterB, `{"_id": {"$eq": "1"}, "$or": [{"version": 0}, {"version": {"$exists": false}}]}`)
+	filterB = withVersion(bson.M{"$or": bson.A{bson.M{"a": 1}, bson.M{"b": 1}}}, 0)
+	assertFilterJSON(t, filterB, `{
+		"$or": [{"a": 1}, {"b": 1}],
+		"$and": [{"$or": [{"version": 0}, {"version": {"$exists": false}}]}]
+	}`)
+
+	if !policyOf[*testVersionDoc]().versioned {
+		t.Errorf("versione non riconosciuta dal tipo")
+	}
+	doc := testVersionDoc{ID: "1", VersionFields: VersionFields{Version: 3}}
+	v, ok := versionedOf(doc)
+	if !ok || v.Versioning().Version != 3 {
+		t.Errorf("documento per valore non riconosciuto come Versioned")
+	}
+	if v, ok := versionedOf(&doc); !ok || v.Versioning() != &doc.VersionFields {
+		t.Errorf("documento per puntatore copiato")
+	}
+	if !isVersionConflictWrite(mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}) {
+		t.Errorf("chiave duplicata dell'upsert non riconosciuta come conflitto")
+	}
+}
+
+func TestVersionUpdate(t *testing.T) {
+	got, err := versionUpdate(bson.M{
+		"$set": bson.M{"name": "x", VersionField: 7},
+		"$inc": bson.M{"n": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := got.(bson.D)
+	set, _ := lookupD(doc, "$set")
+	if _, ok := lookupD(set.(bson.D), VersionField); ok {
+		t.Errorf("versione del chiamante non ignorata: %v", set)
+	}
+	inc, _ := lookupD(doc, "$inc")
+	if v, _ := lookupD(inc.(bson.D), VersionField); v != 1 {
+		t.Errorf("incremento della versione assente: %v", inc)
+	}
+	if n, _ := lookupD(inc.(bson.D), "n"); n == nil {
+		t.Errorf("incremento del chiamante perso: %v", inc)
+	}
+
+	got, err = versionUpdate(bson.M{
+		"$max":         bson.M{VersionField: 9, "n": 2},
+		"$unset":       bson.M{VersionField: ""},
+		"$currentDate": bson.M{VersionField + ".at": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = got.(bson.D)
+	if len(doc) != 2 {
+		t.Errorf("versione del chiamante non rimossa da tutti gli operatori: %v", doc)
+	}
+	if max, _ := lookupD(doc, "$max"); len(max.(bson.D)) != 1 {
+		t.Errorf("$max errato: %v", max)
+	}
+
+	got, err = versionUpdate(bson.M{"$set": bson.M{VersionField: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lookupD(got.(bson.D), "$set"); ok {
+		t.Errorf("$set vuoto non rimosso: %v", got)
+	}
+
+	pipeline, _ := PipelineUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "n", Value: 1}}}}).UpdateDocument()
+	got, err = versionUpdate(pipeline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stages := got.(bson.A); len(stages) != 2 {
+		t.Errorf("stage della versione assente: %v", stages)
+	}
+}
+
+func TestFilterByID(t *testing.T) {
+	filter, err := filterByID(context.Background(), &testVersionDoc{ID: "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.GetFilterCollectionName(context.Background()) != "test_version" {
+		t.Errorf("collection errata")
+	}
+	filterB, err := buildFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FilterToJson(filterB) != FilterToJson(bson.M{"_id": bson.M{"$eq": "42"}}) {
+		t.Errorf("filtro per _id errato: %v", filterB)
+	}
+}
+
+func TestIsVersionConflict(t *testing.T) {
+	if !IsVersionConflict(versionConflictError("test")) {
+		t.Errorf("conflitto non riconosciuto")
+	}
+	if IsVersionConflict(nil) || IsVersionConflict(core.NotFoundError()) {
+		t.Errorf("conflitto riconosciuto su un altro errore")
+	}
+}